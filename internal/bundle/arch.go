@@ -0,0 +1,105 @@
+package bundle
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrWrongPlatform marks an executable built for another OS or architecture
+var ErrWrongPlatform = errors.New("built for another platform")
+
+// CheckPlatform reads the header of the executable at path and returns an
+// ErrWrongPlatform when it was built for something other than goos/goarch.
+// Files that aren't ELF, Mach-O or PE executables (start.sh, say) pass.
+func CheckPlatform(path, goos, goarch string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil
+	}
+
+	var binOS string
+	var arches []string
+	switch {
+	case string(magic) == "\x7fELF":
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		binOS, arches = "linux", []string{elfArch[ef.Machine]}
+	case string(magic[:2]) == "MZ":
+		pf, err := pe.NewFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		binOS, arches = "windows", []string{peArch[pf.Machine]}
+	case isMachO(magic):
+		binOS = "darwin"
+		if ff, err := macho.NewFatFile(f); err == nil {
+			// A universal binary runs wherever one of its slices does
+			for _, a := range ff.Arches {
+				arches = append(arches, machoArch[a.Cpu])
+			}
+		} else if mf, err := macho.NewFile(f); err == nil {
+			arches = []string{machoArch[mf.Cpu]}
+		} else {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil
+	}
+
+	// ELF also serves the BSDs, so only its architecture says anything there
+	osMatches := binOS == goos || (binOS == "linux" && goos != "darwin" && goos != "windows")
+	if osMatches && slices.Contains(arches, goarch) {
+		return nil
+	}
+	for i, a := range arches {
+		if a == "" {
+			arches[i] = "unknown"
+		}
+	}
+	return fmt.Errorf("%w: %s is a %s/%s executable, but this is %s/%s",
+		ErrWrongPlatform, filepath.Base(path), binOS, strings.Join(arches, "+"), goos, goarch)
+}
+
+// isMachO reports whether magic starts a Mach-O file, thin or universal, in
+// either byte order
+func isMachO(magic []byte) bool {
+	switch string(magic) {
+	case "\xfe\xed\xfa\xce", "\xce\xfa\xed\xfe", "\xfe\xed\xfa\xcf", "\xcf\xfa\xed\xfe", "\xca\xfe\xba\xbe":
+		return true
+	}
+	return false
+}
+
+var elfArch = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_386:     "386",
+	elf.EM_ARM:     "arm",
+	elf.EM_RISCV:   "riscv64",
+}
+
+var machoArch = map[macho.Cpu]string{
+	macho.CpuAmd64: "amd64",
+	macho.CpuArm64: "arm64",
+}
+
+var peArch = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+	pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+	pe.IMAGE_FILE_MACHINE_I386:  "386",
+}
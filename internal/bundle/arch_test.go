@@ -0,0 +1,33 @@
+package bundle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckPlatform(t *testing.T) {
+	// The test binary is an executable for this platform
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPlatform(self, runtime.GOOS, runtime.GOARCH); err != nil {
+		t.Errorf("the test binary: %v", err)
+	}
+	other := "arm64"
+	if runtime.GOARCH == "arm64" {
+		other = "amd64"
+	}
+	if err := CheckPlatform(self, runtime.GOOS, other); !errors.Is(err, ErrWrongPlatform) {
+		t.Errorf("checked against %s: got %v, want ErrWrongPlatform", other, err)
+	}
+
+	script := filepath.Join(t.TempDir(), "start.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\nexec ./xmlui-test-server\n"), 0755)
+	if err := CheckPlatform(script, runtime.GOOS, runtime.GOARCH); err != nil {
+		t.Errorf("a script: got %v, want it to pass", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Package bundle downloads, verifies and unpacks the XMLUI release assets.
+// It is shared by the binaries that install them so they fetch and lay out
+// the same files the same way.
+package bundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Settings, set by the caller before the first download
+var (
+	// Dir is where downloads are staged before extraction; "" means the
+	// system temp dir
+	Dir string
+	// CacheDir holds cached copies of downloads that can't change; "" turns
+	// the cache off
+	CacheDir string
+	// Context cancels downloads in flight, and waits between retries, when
+	// it's done
+	Context = context.Background()
+	// Timeout bounds a single download, body included
+	Timeout = 5 * time.Minute
+	// PerHost caps concurrent downloads from one host
+	PerHost = 2
+	// MaxExtractErrors is how many extraction errors are listed before the
+	// rest are summarized
+	MaxExtractErrors = 10
+	// Reproducible extracts zip and tar entries in sorted path order and
+	// keeps archive mtimes (directories' too), so two extractions of the
+	// same archive produce the same tree
+	Reproducible bool
+	// Replace lets MoveIntoPlace swap out an existing app directory rather
+	// than fail
+	Replace bool
+	// NoExecBit strips execute bits from extracted files and makes
+	// EnsureExecutable a no-op, for volumes mounted noexec
+	NoExecBit bool
+	// Downloaded, when set, is told of each completed download and its size
+	Downloaded func(url string, bytes int64)
+	// Warnf reports a problem that doesn't stop the operation
+	Warnf = func(format string, args ...any) {
+		fmt.Println("Warning:", fmt.Sprintf(format, args...))
+	}
+)
+
+// scratch tracks temporary directories and downloads that must not outlive
+// the run, even when it's interrupted
+var scratch struct {
+	sync.Mutex
+	paths []string
+}
+
+// AddScratch tracks path for removal by RemoveScratch or RemoveAllScratch
+func AddScratch(path string) {
+	scratch.Lock()
+	defer scratch.Unlock()
+	scratch.paths = append(scratch.paths, path)
+}
+
+// RemoveScratch deletes a scratch path and stops tracking it
+func RemoveScratch(path string) {
+	scratch.Lock()
+	defer scratch.Unlock()
+	os.RemoveAll(path)
+	for i, p := range scratch.paths {
+		if p == path {
+			scratch.paths = append(scratch.paths[:i], scratch.paths[i+1:]...)
+			break
+		}
+	}
+}
+
+// RemoveAllScratch deletes every scratch path still being tracked
+func RemoveAllScratch() {
+	scratch.Lock()
+	defer scratch.Unlock()
+	for _, path := range scratch.paths {
+		os.RemoveAll(path)
+	}
+	scratch.paths = nil
+}
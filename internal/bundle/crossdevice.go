@@ -0,0 +1,20 @@
+//go:build !plan9
+
+package bundle
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// isCrossDevice reports whether a rename failed because src and dst are on
+// different filesystems
+func isCrossDevice(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	// ERROR_NOT_SAME_DEVICE on Windows
+	return errno == syscall.EXDEV || (runtime.GOOS == "windows" && errno == 17)
+}
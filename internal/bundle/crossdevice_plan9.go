@@ -0,0 +1,14 @@
+package bundle
+
+import (
+	"errors"
+	"os"
+)
+
+// isCrossDevice reports whether a rename failed because src and dst can't be
+// renamed between; Plan 9 only renames within a directory, and refuses
+// anything else with ErrInvalid
+func isCrossDevice(err error) bool {
+	var le *os.LinkError
+	return errors.As(err, &le) && errors.Is(le.Err, os.ErrInvalid)
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package bundle
+
+import (
+	"errors"
+	"runtime"
+)
+
+// FreeSpace returns the bytes available to this user on the volume holding dir
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("not supported on " + runtime.GOOS)
+}
+
+// FreeInodes returns the file slots left on the volume holding dir
+func FreeInodes(dir string) (uint64, error) {
+	return 0, errors.New("not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package bundle
+
+import "syscall"
+
+// FreeSpace returns the bytes available to this user on the volume holding dir
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// FreeInodes returns the file slots left on the volume holding dir
+func FreeInodes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Ffree), nil
+}
@@ -0,0 +1,28 @@
+package bundle
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// FreeSpace returns the bytes available to this user on the volume holding dir
+func FreeSpace(dir string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	if r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return avail, nil
+}
+
+// FreeInodes returns the file slots left on the volume holding dir. NTFS
+// has no fixed inode table to run out of.
+func FreeInodes(dir string) (uint64, error) {
+	return 0, errors.New("not tracked on Windows")
+}
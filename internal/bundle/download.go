@@ -0,0 +1,485 @@
+package bundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is shared by every request so connections to GitHub are reused
+// across downloads. The transport is a clone of the default one (keeping proxy
+// support and keep-alives) with HTTP/2 negotiation forced on.
+var Client = &http.Client{Transport: newTransport()}
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, as curl and git honor them
+	t.Proxy = http.ProxyFromEnvironment
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = 4
+	// A server that accepts the connection but never answers shouldn't hang
+	// the install; downloads also get an overall Timeout
+	t.ResponseHeaderTimeout = time.Minute
+	return t
+}
+
+// ErrAuthFailed marks a download rejected for lack of valid credentials
+var ErrAuthFailed = errors.New("authentication failed")
+
+// DownloadError is a failed download of URL. Status and Code are the HTTP
+// response's, when one came back; Err is the underlying failure, or nil for
+// a plain non-200 response.
+type DownloadError struct {
+	URL    string
+	Status string
+	Code   int
+	Err    error
+}
+
+func (e *DownloadError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("request failed: %s for URL: %s", e.Status, e.URL)
+	}
+	return e.Err.Error()
+}
+
+func (e *DownloadError) Unwrap() error { return e.Err }
+
+// DownloadWithRetry retries Download on transient failures,
+// backing off 1s, 2s, 4s... between attempts
+func DownloadWithRetry(url, filename string, maxAttempts int) (string, error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		archive, err := Download(url, filename)
+		if err == nil || attempt >= maxAttempts || !isTransient(err) {
+			return archive, err
+		}
+		Logf("  %v\n  retry %d/%d in %s...", err, attempt+1, maxAttempts, delay)
+		if err := sleep(delay); err != nil {
+			return "", err
+		}
+		delay *= 2
+	}
+}
+
+// isTransient reports whether a failed download is worth retrying: network
+// errors, timeouts, bodies cut short and 429/5xx responses are. Other
+// statuses (401, 404...) are permanent, as is anything that went wrong on
+// this side, such as a full disk or an unwritable staging dir.
+func isTransient(err error) bool {
+	var de *DownloadError
+	if !errors.As(err, &de) {
+		return false
+	}
+	if de.Err == nil {
+		return de.Code == http.StatusTooManyRequests || de.Code >= 500
+	}
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrStillProcessing) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrDownloadTimeout) || errors.Is(err, ErrIncompleteDownload) || errors.Is(err, ErrEmptyDownload) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// Connection failures, resets included, are *url.Error or *net.OpError
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// sleep waits for d, returning early with Context's error if it's canceled
+func sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-Context.Done():
+		return Context.Err()
+	}
+}
+
+// GitHub answers 202 Accepted for a release asset that was just published
+// and is still being processed; wait this long between attempts
+const (
+	processingAttempts = 5
+	processingDelay    = 3 * time.Second
+)
+
+// ErrStillProcessing means GitHub kept answering 202 for every attempt
+var ErrStillProcessing = errors.New("release asset still processing")
+
+// hostSlots caps concurrent connections per host so parallel downloads don't
+// get throttled by GitHub
+var hostSlots struct {
+	sync.Mutex
+	byHost map[string]chan struct{}
+}
+
+// acquireHost blocks until a download slot for host is free and returns the
+// function that releases it
+func acquireHost(host string) func() {
+	hostSlots.Lock()
+	if hostSlots.byHost == nil {
+		hostSlots.byHost = make(map[string]chan struct{})
+	}
+	slots, ok := hostSlots.byHost[host]
+	if !ok {
+		slots = make(chan struct{}, PerHost)
+		hostSlots.byHost[host] = slots
+	}
+	hostSlots.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// isGitHubHost reports whether host is github.com, one of its subdomains
+// (api, codeload...), or a githubusercontent.com content host
+func isGitHubHost(host string) bool {
+	return host == "github.com" || strings.HasSuffix(host, ".github.com") ||
+		host == "githubusercontent.com" || strings.HasSuffix(host, ".githubusercontent.com")
+}
+
+// isPrivateRepoURL reports whether u is a codeload archive of the private
+// xmlui repo, which takes the token as basic auth
+func isPrivateRepoURL(u *url.URL) bool {
+	return u.Hostname() == "codeload.github.com" && strings.HasPrefix(u.Path, "/xmlui-com/xmlui/")
+}
+
+// Authorize attaches GITHUB_TOKEN, when set, to a request for a GitHub host:
+// basic auth for the private repo on codeload, a Bearer header everywhere
+// else, which also lifts the anonymous rate limit on release downloads.
+// It reports whether a token was attached. (The client drops the header when
+// a release download redirects off to another host.)
+func Authorize(req *http.Request) bool {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" || !isGitHubHost(req.URL.Hostname()) {
+		return false
+	}
+	if isPrivateRepoURL(req.URL) {
+		req.SetBasicAuth(token, "x-oauth-basic")
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return true
+}
+
+// Download streams url to a temp file in Dir, or serves it from the cache, and
+// returns its path. The caller removes it (with RemoveScratch) when done.
+func Download(url, filename string) (string, error) {
+	Logf("Downloading %s...", filename)
+	Logf("  From: %s", url)
+
+	if archive, n := fromCache(url); archive != "" {
+		Logf("  Using cached copy: %d bytes", n)
+		if Downloaded != nil {
+			Downloaded(url, n)
+		}
+		return archive, nil
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", &DownloadError{URL: url, Err: err}
+	}
+	defer acquireHost(req.URL.Host)()
+
+	// The deadline starts once a host slot is free and covers the body too
+	ctx, cancel := context.WithTimeout(Context, Timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	var resp *http.Response
+	failed := func(err error) error {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w after %s: %s", ErrDownloadTimeout, Timeout, url)
+		}
+		de := &DownloadError{URL: url, Err: err}
+		if resp != nil {
+			de.Status, de.Code = resp.Status, resp.StatusCode
+		}
+		return de
+	}
+
+	private := isPrivateRepoURL(req.URL)
+	if Authorize(req) {
+		if private {
+			Logf("  Using authentication token for private repository")
+		}
+	} else if private {
+		Warnf("No authentication token found for private repository")
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err = Client.Do(req)
+		if err != nil {
+			return "", failed(err)
+		}
+		if resp.StatusCode != http.StatusAccepted || attempt == processingAttempts {
+			break
+		}
+		resp.Body.Close()
+		Logf("  release asset still processing, retrying...")
+		if err := sleep(processingDelay); err != nil {
+			return "", failed(fmt.Errorf("%w: %s", err, url))
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusAccepted {
+			return "", failed(fmt.Errorf("%w after %d attempts: %s - try again shortly", ErrStillProcessing, processingAttempts, url))
+		}
+		if private && resp.StatusCode == http.StatusUnauthorized {
+			return "", failed(fmt.Errorf("%w for private repository: %s (status: %s) - check PAT_TOKEN", ErrAuthFailed, url, resp.Status))
+		}
+		return "", &DownloadError{URL: url, Status: resp.Status, Code: resp.StatusCode}
+	}
+
+	out, err := os.CreateTemp(Dir, ".xmlui-download-*")
+	if err != nil {
+		return "", err
+	}
+	AddScratch(out.Name())
+	meter := newDownloadMeter(url, resp.ContentLength)
+	n, err := io.Copy(io.MultiWriter(out, meter), resp.Body)
+	meter.finish()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n == 0 {
+		err = fmt.Errorf("%w: %s (status %s)", ErrEmptyDownload, url, resp.Status)
+	}
+	// A proxy can close the connection early, and the read doesn't always fail
+	if (err == nil || errors.Is(err, io.ErrUnexpectedEOF)) && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("%w: got %d of %d bytes from %s", ErrIncompleteDownload, n, resp.ContentLength, url)
+	}
+	if err != nil {
+		RemoveScratch(out.Name())
+		if !errors.Is(err, ErrEmptyDownload) && !errors.Is(err, ErrIncompleteDownload) {
+			err = fmt.Errorf("downloading %s: %w", url, err)
+		}
+		return "", failed(err)
+	}
+	Logf("  Downloaded: %d bytes", n)
+	if Downloaded != nil {
+		Downloaded(url, n)
+	}
+	addToCache(url, out.Name())
+	return out.Name(), nil
+}
+
+// DownloadProgress, when set, is called as each download's body starts to
+// arrive with its URL and size (-1 if unknown). The func it returns is told
+// the bytes received and time spent as the body arrives, and once more with
+// done set when it stops.
+var DownloadProgress func(url string, size int64) func(received int64, elapsed time.Duration, done bool)
+
+// downloadMeter counts the bytes of a download body and passes them on to
+// the func DownloadProgress returned for it
+type downloadMeter struct {
+	start    time.Time
+	received int64
+	report   func(int64, time.Duration, bool)
+}
+
+func newDownloadMeter(url string, size int64) *downloadMeter {
+	m := &downloadMeter{start: time.Now()}
+	if DownloadProgress != nil {
+		m.report = DownloadProgress(url, size)
+	}
+	return m
+}
+
+func (m *downloadMeter) Write(p []byte) (int, error) {
+	m.received += int64(len(p))
+	if m.report != nil {
+		m.report(m.received, time.Since(m.start), false)
+	}
+	return len(p), nil
+}
+
+func (m *downloadMeter) finish() {
+	if m.report != nil {
+		m.report(m.received, time.Since(m.start), true)
+	}
+}
+
+// cacheable reports whether url always serves the same bytes: release assets
+// and codeload archives pinned to a commit. Branch and tag archives move.
+func cacheable(url string) bool {
+	if strings.Contains(url, "/releases/download/") {
+		return true
+	}
+	return strings.HasPrefix(url, "https://codeload.github.com/") && IsCommitSHA(path.Base(url))
+}
+
+// cacheKey names url's entry in the cache: <key> holds the download and
+// <key>.sha256 the digest it had when stored, followed by the size and mtime
+// it was hashed at
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheStamp is the validity key stored with a cache entry's digest: while
+// the entry's size and mtime still match, the digest is trusted as is
+func cacheStamp(info os.FileInfo) string {
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+// writeCacheDigest records digest as entry's, stamped with its current
+// size and mtime
+func writeCacheDigest(entry, digest string) error {
+	info, err := os.Stat(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(entry+".sha256", []byte(digest+" "+cacheStamp(info)+"\n"), 0644)
+}
+
+// fromCache copies a cached download of url into a scratch file in
+// Dir and returns its path and size, or "" on a miss. An entry is only
+// rehashed when its size or mtime changed since it was last hashed; one
+// whose contents no longer match its stored digest is dropped.
+func fromCache(url string) (string, int64) {
+	dir := CacheDir
+	if dir == "" || !cacheable(url) {
+		return "", 0
+	}
+	entry := filepath.Join(dir, cacheKey(url))
+	sidecar, err := os.ReadFile(entry + ".sha256")
+	if err != nil {
+		return "", 0
+	}
+	fields := strings.Fields(string(sidecar))
+	info, err := os.Stat(entry)
+	if err != nil || len(fields) == 0 {
+		return "", 0
+	}
+	// Entries cached before the stamp existed have only the digest
+	if len(fields) != 3 || fields[1]+" "+fields[2] != cacheStamp(info) {
+		if err := VerifyChecksum(entry, fields[0]); err != nil {
+			Evict(url)
+			return "", 0
+		}
+		writeCacheDigest(entry, fields[0])
+	}
+	in, err := os.Open(entry)
+	if err != nil {
+		return "", 0
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(Dir, ".xmlui-download-*")
+	if err != nil {
+		return "", 0
+	}
+	AddScratch(out.Name())
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		RemoveScratch(out.Name())
+		return "", 0
+	}
+	return out.Name(), n
+}
+
+// addToCache stores a copy of the download of url, with its digest. The
+// cache is only an optimization, so failures are ignored.
+func addToCache(url, archive string) {
+	dir := CacheDir
+	if dir == "" || !cacheable(url) {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	in, err := os.Open(archive)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), in)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return
+	}
+	entry := filepath.Join(dir, cacheKey(url))
+	if os.Rename(tmp.Name(), entry) != nil {
+		return
+	}
+	if writeCacheDigest(entry, hex.EncodeToString(h.Sum(nil))) != nil {
+		os.Remove(entry)
+	}
+}
+
+// Evict drops url's cache entry, e.g. after it failed a published checksum
+func Evict(url string) {
+	if dir := CacheDir; dir != "" {
+		entry := filepath.Join(dir, cacheKey(url))
+		os.Remove(entry + ".sha256")
+		os.Remove(entry)
+	}
+}
+
+// ErrDownloadTimeout means a download ran past Timeout, as opposed
+// to failing outright (connection refused, reset...)
+var ErrDownloadTimeout = errors.New("download timed out")
+
+// ErrIncompleteDownload means the body was shorter (or longer) than its
+// Content-Length; DownloadWithRetry treats it as transient
+var ErrIncompleteDownload = errors.New("incomplete download")
+
+// ErrEmptyDownload means the server answered with no body at all, which
+// would otherwise surface later as a corrupt archive; it's retried too
+var ErrEmptyDownload = errors.New("download is empty")
+
+// VerifyChecksum compares the SHA-256 of the archive with the expected hex digest
+func VerifyChecksum(archive, expected string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s (%d bytes) - the download is corrupt or incomplete, re-run to retry",
+			expected, actual, n)
+	}
+	return nil
+}
+
+// IsCommitSHA reports whether s looks like a full or abbreviated git commit SHA
+func IsCommitSHA(s string) bool {
+	if len(s) < 7 || len(s) > 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
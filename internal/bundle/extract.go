@@ -0,0 +1,649 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrTruncatedZip means a zip is missing its end-of-central-directory record,
+// which almost always means the download was cut short
+var ErrTruncatedZip = errors.New("download appears truncated (zip end-of-central-directory not found) - re-run to retry")
+
+// ErrEmptyArchive means the archive file has no bytes, so the download
+// failed rather than the archive being corrupt
+var ErrEmptyArchive = errors.New("archive is empty (0 bytes) - the download produced nothing")
+
+// openError explains why an archive couldn't be read, so an empty or short
+// download isn't mistaken for a corrupt archive
+func openError(archive string, err error) error {
+	info, statErr := os.Stat(archive)
+	if statErr != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%w: %s", ErrEmptyArchive, archive)
+	}
+	return fmt.Errorf("%s (%d bytes): %w", archive, info.Size(), err)
+}
+
+// ExtractError is the failure to extract one archive entry. Cause already
+// names the entry, so it's what the error reads as.
+type ExtractError struct {
+	Entry string
+	Cause error
+}
+
+func (e *ExtractError) Error() string { return e.Cause.Error() }
+
+func (e *ExtractError) Unwrap() error { return e.Cause }
+
+// entryError wraps err, if any, as an ExtractError for entry
+func entryError(entry string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ExtractError{Entry: entry, Cause: err}
+}
+
+// extractErrors collects per-entry extraction failures so one bad entry
+// doesn't hide the rest, listing the first MaxExtractErrors of them
+type extractErrors struct {
+	listed []error
+	total  int
+}
+
+func (e *extractErrors) add(err error) {
+	if err == nil {
+		return
+	}
+	e.total++
+	if len(e.listed) < MaxExtractErrors {
+		e.listed = append(e.listed, err)
+	}
+}
+
+// err returns the collected failures as one error, or nil if there were none.
+// Several failures are wrapped together, so errors.As still finds each one.
+func (e *extractErrors) err() error {
+	switch {
+	case e.total == 0:
+		return nil
+	case e.total == 1 && len(e.listed) == 1:
+		return e.listed[0]
+	}
+	format := fmt.Sprintf("%d entries failed to extract:", e.total) + strings.Repeat("\n  %w", len(e.listed))
+	if more := e.total - len(e.listed); more > 0 {
+		format += fmt.Sprintf("\n  ... and %d more errors", more)
+	}
+	args := make([]any, len(e.listed))
+	for i, err := range e.listed {
+		args[i] = err
+	}
+	return fmt.Errorf(format, args...)
+}
+
+// hasZipEOCD reports whether the end-of-central-directory signature appears in
+// the last 64KB+22 bytes of the archive, where the zip format requires it to be
+func hasZipEOCD(archive string) bool {
+	f, err := os.Open(archive)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	size := min(info.Size(), 65535+22)
+	tail := make([]byte, size)
+	if _, err := f.ReadAt(tail, info.Size()-size); err != nil {
+		return false
+	}
+	return bytes.Contains(tail, []byte("PK\x05\x06"))
+}
+
+// Progress, when set, is told the cumulative bytes written and time
+// spent as an archive extracts, and once more with done set when it finishes
+var Progress func(written int64, elapsed time.Duration, done bool)
+
+// extractMeter counts the bytes an extractor writes and passes them on to
+// Progress
+type extractMeter struct {
+	start   time.Time
+	written int64
+}
+
+func newExtractMeter() *extractMeter {
+	return &extractMeter{start: time.Now()}
+}
+
+func (m *extractMeter) Write(p []byte) (int, error) {
+	m.written += int64(len(p))
+	if Progress != nil {
+		Progress(m.written, time.Since(m.start), false)
+	}
+	return len(p), nil
+}
+
+func (m *extractMeter) finish() {
+	if Progress != nil {
+		Progress(m.written, time.Since(m.start), true)
+	}
+}
+
+// SanitizeExtractPath resolves an archive entry name against dest, refusing
+// entries like ../../etc/cron.d/x that would land outside it (zip-slip)
+func SanitizeExtractPath(dest, name string) (string, error) {
+	destAbs, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+	fpath := filepath.Join(destAbs, filepath.FromSlash(name))
+	if fpath != destAbs && !strings.HasPrefix(fpath, strings.TrimSuffix(destAbs, string(filepath.Separator))+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %q: it would be written outside %s", name, dest)
+	}
+	return fpath, nil
+}
+
+// resolveExisting follows the symlinks along path as far as it exists on
+// disk, and returns that resolved prefix joined with the rest of path
+func resolveExisting(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			// A dangling link fails here, which refuses it
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// checkResolved refuses path when following the symlinks already on disk
+// takes it outside dest. SanitizeExtractPath only checks the entry name, and
+// an archive can plant a link (a -> .., say) and then write through it.
+func checkResolved(dest, path string) error {
+	destReal, err := resolveExisting(dest)
+	if err != nil {
+		return err
+	}
+	real, err := resolveExisting(path)
+	if err != nil {
+		return fmt.Errorf("refusing to extract %s: %w", path, err)
+	}
+	if real != destReal && !strings.HasPrefix(real, strings.TrimSuffix(destReal, string(filepath.Separator))+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to extract %s: through a symlink it would be written outside %s", path, dest)
+	}
+	return nil
+}
+
+// Unzip extracts a zip archive into dest
+func Unzip(archive, dest string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		if DetectFormat(archive) == "zip" && !hasZipEOCD(archive) {
+			return ErrTruncatedZip
+		}
+		return openError(archive, err)
+	}
+	defer r.Close()
+	meter := newExtractMeter()
+	defer meter.finish()
+	files := r.File
+	if Reproducible {
+		files = slices.Clone(files)
+		slices.SortFunc(files, func(a, b *zip.File) int { return strings.Compare(a.Name, b.Name) })
+	}
+	var errs extractErrors
+	var dirs []dirMtime
+	for _, f := range files {
+		fpath, err := SanitizeExtractPath(dest, f.Name)
+		if err == nil {
+			err = checkResolved(dest, fpath)
+		}
+		if err != nil {
+			return entryError(f.Name, err)
+		}
+		if f.FileInfo().IsDir() {
+			os.MkdirAll(fpath, 0755)
+			dirs = append(dirs, dirMtime{fpath, f.Modified})
+			continue
+		}
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		errs.add(entryError(f.Name, unzipFile(f, fpath, meter)))
+	}
+	restoreDirMtimes(dirs)
+	return errs.err()
+}
+
+// unzipFile writes a single zip entry to fpath
+func unzipFile(f *zip.File, fpath string, meter *extractMeter) error {
+	in, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", f.Name, err)
+	}
+	defer in.Close()
+	// Zero-length entries (.gitkeep, empty config stubs the app relies on)
+	// are still created here; the copy below just writes nothing
+	out, err := createFile(fpath, f.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(entryWriter(out), meter), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fpath)
+		return fmt.Errorf("failed to write %s: %w", f.Name, err)
+	}
+	Detailf("  %s", f.Name)
+	applyMode(fpath, f.Mode())
+	PreserveMtime(fpath, f.Modified)
+	return nil
+}
+
+// entryWriter is what an entry's bytes are written through; tests swap it to
+// simulate a disk that fills mid-file
+var entryWriter = func(f *os.File) io.Writer { return f }
+
+// createFile creates (or truncates) fpath for an archive entry with the
+// entry's permission bits, or 0644 when the archive recorded none, so the
+// file is never briefly more open than it will end up
+func createFile(fpath string, mode os.FileMode) (*os.File, error) {
+	mode = mode.Perm()
+	if NoExecBit {
+		mode &^= 0111
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	return os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+// applyMode carries over the permission bits recorded in an archive entry,
+// minus the execute bits under NoExecBit. Archives written without Unix
+// modes record 0, which leaves the file as created.
+func applyMode(fpath string, mode os.FileMode) {
+	mode = mode.Perm()
+	if NoExecBit {
+		mode &^= 0111
+	}
+	if mode == 0 {
+		return
+	}
+	if err := chmodWithRepair(fpath, mode); err != nil {
+		Warnf("Could not set permissions on %s: %v", fpath, err)
+		return
+	}
+	Detailf("  chmod %v %s", mode, fpath)
+}
+
+// chmodWithRepair chmods path, and if that fails because the archive left its
+// parent directory without owner access, restores that access and retries
+func chmodWithRepair(path string, mode os.FileMode) error {
+	err := os.Chmod(path, mode)
+	if err == nil {
+		return nil
+	}
+	parent := filepath.Dir(path)
+	info, statErr := os.Stat(parent)
+	if statErr != nil || info.Mode().Perm()&0700 == 0700 {
+		return err
+	}
+	if os.Chmod(parent, info.Mode().Perm()|0700) != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// PreserveMtime stamps path with the mtime recorded in its archive (or source
+// tree) under Reproducible; otherwise files keep the time they were written
+func PreserveMtime(path string, mtime time.Time) {
+	if Reproducible && !mtime.IsZero() {
+		os.Chtimes(path, mtime, mtime)
+	}
+}
+
+// stripComponents drops the first strip leading path components of an
+// archive entry name, reporting false when nothing is left
+func stripComponents(name string, strip int) (string, bool) {
+	if strip == 0 {
+		return name, true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "./"), "/", strip+1)
+	if len(parts) <= strip || parts[strip] == "" {
+		return "", false
+	}
+	return parts[strip], true
+}
+
+// checkSymlinkTarget refuses a symlink at fpath whose target would resolve
+// outside dest, since later entries could then be written through it
+func checkSymlinkTarget(dest, fpath, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("refusing to extract symlink %s -> %s: absolute target", fpath, linkname)
+	}
+	// Resolve both ends, so the target is judged from where the link really
+	// lands rather than from its name in the archive
+	destReal, err := resolveExisting(dest)
+	if err != nil {
+		return err
+	}
+	dirReal, err := resolveExisting(filepath.Dir(fpath))
+	if err != nil {
+		return err
+	}
+	relDir, err := filepath.Rel(destReal, dirReal)
+	if err != nil {
+		return err
+	}
+	if _, err := SanitizeExtractPath(dest, filepath.Join(relDir, filepath.FromSlash(linkname))); err != nil {
+		return fmt.Errorf("refusing to extract symlink %s -> %s: it points outside %s", fpath, linkname, dest)
+	}
+	return nil
+}
+
+// UntarGz extracts a tar.gz archive into dest
+func UntarGz(archive, dest string) error {
+	return UntarGzStrip(archive, dest, 0)
+}
+
+// UntarGzStrip extracts a tar.gz into dest, dropping the first strip
+// leading path components of each entry like tar --strip-components
+func UntarGzStrip(archive, dest string, strip int) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return openError(archive, err)
+	}
+	// Some release tarballs are concatenated gzip members; read them all as
+	// one stream rather than stopping at the end of the first member. That's
+	// the default, spelled out so nobody turns it off to read just one.
+	gzReader.Multistream(true)
+	tarReader := tar.NewReader(gzReader)
+	meter := newExtractMeter()
+	defer meter.finish()
+	x := &tarExtractor{dest: dest, strip: strip, meter: meter}
+	// Under Reproducible the entries are buffered and extracted in sorted
+	// path order, since archive order is whatever the packer happened to use
+	var entries []tarEntry
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The stream itself is broken, so there's nothing more to read
+			x.errs.add(err)
+			return x.errs.err()
+		}
+		if !Reproducible {
+			if err := x.entry(hdr, tarReader); err != nil {
+				return err
+			}
+			continue
+		}
+		body, err := io.ReadAll(tarReader)
+		if err != nil {
+			x.errs.add(err)
+			return x.errs.err()
+		}
+		entries = append(entries, tarEntry{hdr, body})
+	}
+	// Links go last so a hard link's target already exists, and no file is
+	// written through a symlink that sorted ahead of it
+	isLink := func(e tarEntry) bool {
+		return e.hdr.Typeflag == tar.TypeSymlink || e.hdr.Typeflag == tar.TypeLink
+	}
+	slices.SortFunc(entries, func(a, b tarEntry) int {
+		if isLink(a) != isLink(b) {
+			if isLink(a) {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.hdr.Name, b.hdr.Name)
+	})
+	for _, e := range entries {
+		if err := x.entry(e.hdr, bytes.NewReader(e.body)); err != nil {
+			return err
+		}
+	}
+	restoreDirMtimes(x.dirs)
+	return x.errs.err()
+}
+
+// tarEntry is a tar entry held in memory until it's extracted
+type tarEntry struct {
+	hdr  *tar.Header
+	body []byte
+}
+
+// tarExtractor carries the state of one UntarGzStrip across its entries
+type tarExtractor struct {
+	dest  string
+	strip int
+	meter io.Writer
+	errs  extractErrors
+	dirs  []dirMtime
+}
+
+// entry extracts one tar entry, reading a regular file's content from body.
+// Entry failures are collected in x.errs; the error returned is one that
+// should stop the whole extraction (an entry escaping dest).
+func (x *tarExtractor) entry(hdr *tar.Header, body io.Reader) error {
+	dest, strip := x.dest, x.strip
+	// GitHub tarballs start with a pax global header carrying the commit id
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	name, ok := stripComponents(hdr.Name, strip)
+	if !ok {
+		return nil
+	}
+	fpath, err := SanitizeExtractPath(dest, name)
+	if err == nil {
+		// A link entry replaces whatever is at fpath, so only its parent
+		// has to resolve inside dest
+		resolved := fpath
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			resolved = filepath.Dir(fpath)
+		}
+		err = checkResolved(dest, resolved)
+	}
+	if err != nil {
+		return entryError(hdr.Name, err)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		os.MkdirAll(fpath, 0755)
+		x.dirs = append(x.dirs, dirMtime{fpath, hdr.ModTime})
+		return nil
+	case tar.TypeSymlink:
+		if err := checkSymlinkTarget(dest, fpath, hdr.Linkname); err != nil {
+			return entryError(hdr.Name, err)
+		}
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		os.Remove(fpath)
+		if err := os.Symlink(hdr.Linkname, fpath); err != nil {
+			x.errs.add(entryError(hdr.Name, fmt.Errorf("failed to link %s: %w", hdr.Name, err)))
+			return nil
+		}
+		Detailf("  %s -> %s", hdr.Name, hdr.Linkname)
+		return nil
+	case tar.TypeLink:
+		// Hard link targets name another entry in the archive
+		target, ok := stripComponents(hdr.Linkname, strip)
+		if !ok {
+			x.errs.add(entryError(hdr.Name, fmt.Errorf("failed to link %s: target %s was stripped", hdr.Name, hdr.Linkname)))
+			return nil
+		}
+		tpath, err := SanitizeExtractPath(dest, target)
+		if err == nil {
+			err = checkResolved(dest, tpath)
+		}
+		if err != nil {
+			return entryError(hdr.Name, err)
+		}
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		os.Remove(fpath)
+		if err := os.Link(tpath, fpath); err != nil {
+			x.errs.add(entryError(hdr.Name, fmt.Errorf("failed to link %s: %w", hdr.Name, err)))
+		}
+		return nil
+	case tar.TypeReg:
+	default:
+		Warnf("Skipping %s: unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	os.MkdirAll(filepath.Dir(fpath), 0755)
+	out, err := createFile(fpath, hdr.FileInfo().Mode())
+	if err != nil {
+		x.errs.add(entryError(hdr.Name, err))
+		return nil
+	}
+	if _, err := io.Copy(io.MultiWriter(entryWriter(out), x.meter), body); err != nil {
+		// Don't leave a truncated file behind (e.g. when the disk fills mid-file)
+		out.Close()
+		os.Remove(fpath)
+		x.errs.add(entryError(hdr.Name, fmt.Errorf("failed to write %s: %w", hdr.Name, err)))
+		return nil
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(fpath)
+		x.errs.add(entryError(hdr.Name, fmt.Errorf("failed to write %s: %w", hdr.Name, err)))
+		return nil
+	}
+	Detailf("  %s", hdr.Name)
+	applyMode(fpath, hdr.FileInfo().Mode())
+	PreserveMtime(fpath, hdr.ModTime)
+
+	// Older releases were packed without execute bits, so make sure the
+	// known binaries can still run
+	if hdr.FileInfo().Mode()&0111 == 0 && (filepath.Base(fpath) == "xmlui-mcp" ||
+		filepath.Base(fpath) == "xmlui-mcp-client" || filepath.Base(fpath) == "xmlui-test-server") {
+		EnsureExecutable(fpath)
+	}
+	return nil
+}
+
+// dirMtime is a directory entry's recorded mtime, restored once everything
+// under it has been written
+type dirMtime struct {
+	path  string
+	mtime time.Time
+}
+
+// restoreDirMtimes stamps extracted directories with their archive mtimes
+// under Reproducible, deepest first, since writing into a directory (or
+// stamping a child directory) bumps its mtime
+func restoreDirMtimes(dirs []dirMtime) {
+	slices.SortFunc(dirs, func(a, b dirMtime) int { return strings.Compare(b.path, a.path) })
+	for _, d := range dirs {
+		PreserveMtime(d.path, d.mtime)
+	}
+}
+
+// DetectFormat sniffs the leading magic bytes of an archive
+func DetectFormat(archive string) string {
+	f, err := os.Open(archive)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 4)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	default:
+		return ""
+	}
+}
+
+// Extract extracts the archive into dest using the given format,
+// sniffing the content when format is "auto"
+func Extract(archive, dest, format string) error {
+	if format == "auto" {
+		format = DetectFormat(archive)
+	}
+	switch format {
+	case "zip":
+		return Unzip(archive, dest)
+	case "tar.gz":
+		return UntarGz(archive, dest)
+	}
+	return openError(archive, errors.New("unrecognized archive format (expected zip or tar.gz)"))
+}
+
+// Walk calls fn for each entry of a zip or tar.gz archive, in archive
+// order, without extracting anything
+func Walk(archive string, fn func(name string, size int64, mode os.FileMode)) error {
+	switch DetectFormat(archive) {
+	case "zip":
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return openError(archive, err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			fn(f.Name, int64(f.UncompressedSize64), f.Mode())
+		}
+	case "tar.gz":
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gzReader, err := gzip.NewReader(f)
+		if err != nil {
+			return openError(archive, err)
+		}
+		tarReader := tar.NewReader(gzReader)
+		for {
+			hdr, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fn(hdr.Name, hdr.Size, hdr.FileInfo().Mode())
+		}
+	default:
+		return openError(archive, errors.New("unrecognized archive format (expected zip or tar.gz)"))
+	}
+	return nil
+}
@@ -0,0 +1,481 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtureEntry is one entry of a test archive: a file with body, a directory
+// when name ends in /, or a symlink to link (a hard link when hard is set)
+type fixtureEntry struct {
+	name  string
+	body  string
+	mode  os.FileMode
+	link  string
+	hard  bool
+	mtime time.Time
+}
+
+func zipFixture(t *testing.T, entries []fixtureEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.mtime}
+		if e.mode != 0 {
+			hdr.SetMode(e.mode)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzFixture(t *testing.T, entries []fixtureEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body)), ModTime: e.mtime}
+		switch {
+		case e.link != "" && e.hard:
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, e.link, 0
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if e.mode != 0 {
+			hdr.Mode = int64(e.mode)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeFixture saves an archive to a temp file and returns its path
+func writeFixture(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixture")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkTree fails unless dest holds exactly the files in want, by slash path
+func checkTree(t *testing.T, dest string, want map[string]string) {
+	t.Helper()
+	got := map[string]string{}
+	filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dest, path)
+		got[filepath.ToSlash(rel)] = string(body)
+		return nil
+	})
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("%s: got %q, want %q", name, got[name], body)
+		}
+		delete(got, name)
+	}
+	for name := range got {
+		t.Errorf("unexpected file %s", name)
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	archive := writeFixture(t, zipFixture(t, []fixtureEntry{
+		{name: "xmlui-invoice-main/"},
+		{name: "xmlui-invoice-main/index.html", body: "<App/>"},
+		{name: "xmlui-invoice-main/.gitkeep"},
+		{name: "xmlui-invoice-main/start.sh", body: "#!/bin/sh\n", mode: 0755},
+	}))
+	dest := t.TempDir()
+	if err := Unzip(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"xmlui-invoice-main/index.html": "<App/>",
+		"xmlui-invoice-main/.gitkeep":   "",
+		"xmlui-invoice-main/start.sh":   "#!/bin/sh\n",
+	})
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dest, "xmlui-invoice-main", "start.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0755 {
+			t.Errorf("start.sh has mode %v, want the archive's 0755", info.Mode().Perm())
+		}
+	}
+}
+
+// Zero-length entries are real files the app relies on (.gitkeep, empty
+// config stubs): they must be created, with their recorded modes
+func TestUnzipEmptyFiles(t *testing.T) {
+	archive := writeFixture(t, zipFixture(t, []fixtureEntry{
+		{name: "app/.gitkeep", mode: 0644},
+		{name: "app/config/empty.json", mode: 0600},
+		{name: "app/hooks/noop.sh", mode: 0755},
+	}))
+	dest := t.TempDir()
+	if err := Unzip(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"app/.gitkeep":          "",
+		"app/config/empty.json": "",
+		"app/hooks/noop.sh":     "",
+	})
+	if runtime.GOOS == "windows" {
+		return
+	}
+	for name, want := range map[string]os.FileMode{
+		"app/.gitkeep":          0644,
+		"app/config/empty.json": 0600,
+		"app/hooks/noop.sh":     0755,
+	} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 || info.Mode().Perm() != want {
+			t.Errorf("%s: %d bytes, mode %v; want empty with %v", name, info.Size(), info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestUnzipTraversal(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	archive := writeFixture(t, zipFixture(t, []fixtureEntry{
+		{name: "ok.txt", body: "ok"},
+		{name: "../evil.txt", body: "pwned"},
+	}))
+	err := Unzip(archive, dest)
+	if err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("got %v, want a refusal to write outside dest", err)
+	}
+	var ee *ExtractError
+	if !errors.As(err, &ee) || ee.Entry != "../evil.txt" {
+		t.Errorf("got %#v, want an ExtractError for ../evil.txt", ee)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+		t.Error("../evil.txt was written outside dest")
+	}
+}
+
+func TestUnzipTruncated(t *testing.T) {
+	data := zipFixture(t, []fixtureEntry{{name: "a.txt", body: strings.Repeat("a", 1000)}})
+	archive := writeFixture(t, data[:len(data)/2])
+	if err := Unzip(archive, t.TempDir()); err != ErrTruncatedZip {
+		t.Fatalf("got %v, want ErrTruncatedZip", err)
+	}
+}
+
+// shortWriter accepts the first limit bytes and then writes short, as a full
+// disk does
+type shortWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	n := min(len(p), s.limit)
+	n, err := s.w.Write(p[:n])
+	s.limit -= n
+	return n, err
+}
+
+func TestExtractShortWrite(t *testing.T) {
+	entries := []fixtureEntry{
+		{name: "ok.txt", body: "ok"},
+		{name: "big.txt", body: strings.Repeat("x", 10000)},
+	}
+	saved := entryWriter
+	t.Cleanup(func() { entryWriter = saved })
+	for format, data := range map[string][]byte{
+		"zip":    zipFixture(t, entries),
+		"tar.gz": tarGzFixture(t, entries),
+	} {
+		entryWriter = func(f *os.File) io.Writer { return &shortWriter{w: f, limit: 100} }
+		dest := t.TempDir()
+		err := Extract(writeFixture(t, data), dest, format)
+		if !errors.Is(err, io.ErrShortWrite) {
+			t.Errorf("%s: got %v, want io.ErrShortWrite", format, err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "big.txt")); err == nil {
+			t.Errorf("%s: the partly written big.txt was left behind", format)
+		}
+	}
+}
+
+// Under Reproducible both formats are extracted in sorted path order, and
+// every file and directory ends up with its archive mtime
+func TestExtractReproducible(t *testing.T) {
+	dirTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileTime := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+	entries := []fixtureEntry{
+		{name: "app/", mtime: dirTime},
+		{name: "app/sub/", mtime: dirTime},
+		{name: "app/z.txt", body: "z", mtime: fileTime},
+		{name: "app/sub/b.txt", body: "b", mtime: fileTime},
+		{name: "app/a.txt", body: "a", mtime: fileTime},
+	}
+	savedWriter, savedReproducible := entryWriter, Reproducible
+	t.Cleanup(func() { entryWriter, Reproducible = savedWriter, savedReproducible })
+	Reproducible = true
+	for format, data := range map[string][]byte{
+		"zip":    zipFixture(t, entries),
+		"tar.gz": tarGzFixture(t, entries),
+	} {
+		dest := t.TempDir()
+		var order []string
+		entryWriter = func(f *os.File) io.Writer {
+			rel, _ := filepath.Rel(dest, f.Name())
+			order = append(order, filepath.ToSlash(rel))
+			return f
+		}
+		if err := Extract(writeFixture(t, data), dest, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if want := []string{"app/a.txt", "app/sub/b.txt", "app/z.txt"}; !slices.Equal(order, want) {
+			t.Errorf("%s: extracted %v, want %v", format, order, want)
+		}
+		for rel, want := range map[string]time.Time{
+			"app": dirTime, "app/sub": dirTime, "app/a.txt": fileTime, "app/sub/b.txt": fileTime,
+		} {
+			info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(rel)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(want) {
+				t.Errorf("%s: %s has mtime %v, want %v", format, rel, info.ModTime().UTC(), want)
+			}
+		}
+	}
+}
+
+func TestExtractEmpty(t *testing.T) {
+	archive := writeFixture(t, nil)
+	for _, format := range []string{"zip", "tar.gz", "auto"} {
+		if err := Extract(archive, t.TempDir(), format); !errors.Is(err, ErrEmptyArchive) {
+			t.Errorf("%s: got %v, want ErrEmptyArchive", format, err)
+		}
+	}
+}
+
+func TestUntarGz(t *testing.T) {
+	archive := writeFixture(t, tarGzFixture(t, []fixtureEntry{
+		{name: "xmlui-mcp/"},
+		{name: "xmlui-mcp/xmlui-mcp", body: "binary", mode: 0644},
+		{name: "xmlui-mcp/README.md", body: "# MCP"},
+		{name: "xmlui-mcp/latest", link: "xmlui-mcp"},
+	}))
+	dest := t.TempDir()
+	if err := UntarGz(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"xmlui-mcp/xmlui-mcp": "binary",
+		"xmlui-mcp/README.md": "# MCP",
+	})
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "xmlui-mcp", "latest")); err != nil || target != "xmlui-mcp" {
+		t.Errorf("latest links to %q (%v), want xmlui-mcp", target, err)
+	}
+	// Older releases were packed without execute bits on the binaries
+	info, err := os.Stat(filepath.Join(dest, "xmlui-mcp", "xmlui-mcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		t.Errorf("xmlui-mcp has mode %v, want it executable", info.Mode().Perm())
+	}
+}
+
+// Some release tarballs are one tar stream split across concatenated gzip
+// members; every member has to be read, not just the first
+func TestUntarGzMultistream(t *testing.T) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range []string{"xmlui-test-server/first.txt", "xmlui-test-server/second.txt"} {
+		body := strings.Repeat(name, 100)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Split after the first entry, so the second lives only in member two
+	raw := tarBuf.Bytes()
+	split := 512 + (len(raw)/2/512)*512
+	var archive bytes.Buffer
+	for _, part := range [][]byte{raw[:split], raw[split:]} {
+		gw := gzip.NewWriter(&archive)
+		gw.Write(part)
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := t.TempDir()
+	if err := UntarGz(writeFixture(t, archive.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"xmlui-test-server/first.txt":  strings.Repeat("xmlui-test-server/first.txt", 100),
+		"xmlui-test-server/second.txt": strings.Repeat("xmlui-test-server/second.txt", 100),
+	})
+}
+
+func TestUntarGzStrip(t *testing.T) {
+	archive := writeFixture(t, tarGzFixture(t, []fixtureEntry{
+		{name: "xmlui-invoice-main/"},
+		{name: "xmlui-invoice-main/index.html", body: "<App/>"},
+	}))
+	dest := t.TempDir()
+	if err := UntarGzStrip(archive, dest, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{"index.html": "<App/>"})
+}
+
+func TestUntarGzSymlinkEscape(t *testing.T) {
+	archive := writeFixture(t, tarGzFixture(t, []fixtureEntry{
+		{name: "etc", link: "../../etc"},
+	}))
+	err := UntarGz(archive, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "points outside") {
+		t.Fatalf("got %v, want a refusal to link outside dest", err)
+	}
+	var ee *ExtractError
+	if !errors.As(err, &ee) || ee.Entry != "etc" {
+		t.Errorf("got %#v, want an ExtractError for etc", ee)
+	}
+}
+
+// Each link passes a check of its name alone; only following the links
+// already extracted shows the write escaping dest
+func TestUntarGzSymlinkChain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	for name, entries := range map[string][]fixtureEntry{
+		"symlink": {
+			{name: "a", link: "."},
+			{name: "a/b", link: ".."},
+			{name: "b/evil.txt", body: "pwned"},
+		},
+		"hard link": {
+			{name: "x/s", link: ".."},
+			{name: "h", link: "x/s", hard: true},
+			{name: "h/evil.txt", body: "pwned"},
+		},
+	} {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		err := UntarGz(writeFixture(t, tarGzFixture(t, entries)), dest)
+		if err == nil || !strings.Contains(err.Error(), "outside") {
+			t.Errorf("%s: got %v, want a refusal to write outside dest", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+			t.Errorf("%s: evil.txt was written outside dest", name)
+		}
+	}
+}
+
+func TestUntarGzEntryErrors(t *testing.T) {
+	archive := writeFixture(t, tarGzFixture(t, []fixtureEntry{
+		{name: "a/b.txt", body: "b"},
+		{name: "c/d.txt", body: "d"},
+		{name: "e.txt", body: "e"},
+	}))
+	dest := t.TempDir()
+	// Files where a/ and c/ belong make both entries fail, but not e.txt
+	os.WriteFile(filepath.Join(dest, "a"), nil, 0644)
+	os.WriteFile(filepath.Join(dest, "c"), nil, 0644)
+
+	err := UntarGz(archive, dest)
+	if err == nil || !strings.Contains(err.Error(), "2 entries failed") {
+		t.Fatalf("got %v, want 2 entries failed", err)
+	}
+	var ee *ExtractError
+	if !errors.As(err, &ee) || ee.Entry != "a/b.txt" {
+		t.Errorf("got %#v, want an ExtractError for a/b.txt first", ee)
+	}
+	if body, _ := os.ReadFile(filepath.Join(dest, "e.txt")); string(body) != "e" {
+		t.Error("e.txt wasn't extracted past the failures")
+	}
+}
+
+func TestUntarGzTruncated(t *testing.T) {
+	data := tarGzFixture(t, []fixtureEntry{{name: "a.txt", body: strings.Repeat("abc", 10000)}})
+	archive := writeFixture(t, data[:len(data)/2])
+	dest := t.TempDir()
+	if err := UntarGz(archive, dest); err == nil {
+		t.Fatal("truncated tar.gz extracted without error")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); err == nil {
+		t.Error("the partly written a.txt was left behind")
+	}
+}
+
+func TestExtractDetectsFormat(t *testing.T) {
+	for format, data := range map[string][]byte{
+		"zip":    zipFixture(t, []fixtureEntry{{name: "a.txt", body: "a"}}),
+		"tar.gz": tarGzFixture(t, []fixtureEntry{{name: "a.txt", body: "a"}}),
+	} {
+		archive := writeFixture(t, data)
+		if got := DetectFormat(archive); got != format {
+			t.Errorf("DetectFormat = %q, want %q", got, format)
+		}
+		dest := t.TempDir()
+		if err := Extract(archive, dest, "auto"); err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		checkTree(t, dest, map[string]string{"a.txt": "a"})
+	}
+
+	if err := Extract(writeFixture(t, []byte("<!doctype html>")), t.TempDir(), "auto"); err == nil {
+		t.Error("an HTML page extracted without error")
+	}
+}
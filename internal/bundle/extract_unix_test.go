@@ -0,0 +1,41 @@
+//go:build unix
+
+package bundle
+
+import (
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// With umask 0, extraction alone decides the modes, so nothing group or
+// other writable may come out of it
+func TestExtractDirModes(t *testing.T) {
+	old := syscall.Umask(0)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	entries := []fixtureEntry{
+		{name: "xmlui-mcp/", mode: 0777},
+		{name: "xmlui-mcp/docs/pages/index.md", body: "# Docs"},
+		{name: "xmlui-mcp/xmlui-mcp", body: "binary", mode: 0755},
+	}
+	for format, data := range map[string][]byte{
+		"zip":    zipFixture(t, entries),
+		"tar.gz": tarGzFixture(t, entries),
+	} {
+		dest := t.TempDir()
+		if err := Extract(writeFixture(t, data), dest, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() || path == dest {
+				return err
+			}
+			if info, err := d.Info(); err == nil && info.Mode().Perm()&0022 != 0 {
+				t.Errorf("%s: %s has mode %v", format, path, info.Mode().Perm())
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// EnsureExecutable sets the execute bits on path unless NoExecBit is set.
+// A failure is only a warning: some volumes refuse chmod, and the files can
+// still be run through an interpreter.
+func EnsureExecutable(path string) {
+	if NoExecBit || runtime.GOOS == "windows" {
+		return
+	}
+	if err := chmodWithRepair(path, 0755); err != nil {
+		Warnf("Could not make %s executable: %v", path, err)
+		return
+	}
+	Detailf("  chmod 0755 %s", path)
+}
+
+// MoveIntoPlace moves the extracted repo folder (or the subdir within it, if
+// given) to installDir/repoName. An existing installDir/repoName, say from
+// an earlier run, is an ErrDestinationExists unless Replace is set.
+func MoveIntoPlace(srcParent, repoName, installDir, subdir string) (string, error) {
+	repoPrefix := repoName + "-"
+	entries, err := os.ReadDir(srcParent)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), repoPrefix) {
+			extracted := filepath.Join(srcParent, e.Name())
+			tmp := extracted
+			if subdir != "" {
+				tmp = filepath.Join(extracted, filepath.FromSlash(subdir))
+				if info, err := os.Stat(tmp); err != nil || !info.IsDir() {
+					return "", fmt.Errorf("app subdir %q not found in %s", subdir, e.Name())
+				}
+			}
+			final := filepath.Join(installDir, repoName)
+			if err := moveOver(tmp, final); err != nil {
+				return "", err
+			}
+			if subdir != "" {
+				// Drop the rest of the archive around the app subtree
+				os.RemoveAll(extracted)
+			}
+			return final, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no %s* folder in %s", ErrRepoDirNotFound, repoPrefix, srcParent)
+}
+
+// moveOver moves src to dst. If dst exists and Replace is set, it's moved
+// aside first and put back should the move fail.
+func moveOver(src, dst string) error {
+	if _, err := os.Lstat(dst); err != nil {
+		return MoveOrCopy(src, dst)
+	}
+	if !Replace {
+		return &LayoutError{Op: "move", Path: dst, Err: ErrDestinationExists}
+	}
+	old := dst + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(dst, old); err != nil {
+		return &LayoutError{Op: "move aside", Path: dst, Err: err}
+	}
+	if err := MoveOrCopy(src, dst); err != nil {
+		os.RemoveAll(dst)
+		os.Rename(old, dst)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return &LayoutError{Op: "remove", Path: old, Err: err}
+	}
+	return nil
+}
+
+// MoveOrCopy renames src to dst, falling back to a copy and delete when they
+// are on different filesystems (e.g. a temp dir on tmpfs)
+func MoveOrCopy(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !isCrossDevice(err) {
+		return &LayoutError{Op: "move", Path: dst, Err: err}
+	}
+	if err := copyPreserving(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return &LayoutError{Op: "copy", Path: dst, Err: err}
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return &LayoutError{Op: "remove", Path: src, Err: err}
+	}
+	return nil
+}
+
+// copyPreserving recursively copies src to dst, keeping symlinks, file
+// modes and mtimes
+func copyPreserving(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := copyPreserving(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		os.Chmod(dst, info.Mode().Perm())
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// ErrRepoDirNotFound means the app archive extracted without the
+// xmlui-invoice-<ref>/ folder codeload normally wraps it in
+var ErrRepoDirNotFound = errors.New("repo dir not found")
+
+// LayoutError is a failure to move, copy or remove Path while laying out the
+// install
+type LayoutError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *LayoutError) Unwrap() error { return e.Err }
+
+// ErrDestinationExists means MoveIntoPlace found the app directory already
+// there and Replace wasn't set
+var ErrDestinationExists = errors.New("destination already exists")
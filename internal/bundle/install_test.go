@@ -0,0 +1,117 @@
+package bundle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// extractedApp lays out what extracting the app archive into a fresh dir
+// leaves: the codeload folder holding index.html
+func extractedApp(t *testing.T, body string) string {
+	t.Helper()
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "xmlui-invoice-main")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return parent
+}
+
+func TestMoveIntoPlace(t *testing.T) {
+	parent := extractedApp(t, "<App/>")
+	final, err := MoveIntoPlace(parent, "xmlui-invoice", parent, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != filepath.Join(parent, "xmlui-invoice") {
+		t.Errorf("moved to %s", final)
+	}
+	checkTree(t, parent, map[string]string{"xmlui-invoice/index.html": "<App/>"})
+}
+
+// Install paths like /Users/José García/My Apps must survive extraction and
+// the move into place unmangled
+func TestMoveIntoPlaceUnusualPath(t *testing.T) {
+	installDir := filepath.Join(t.TempDir(), "My Apps", "José")
+	archive := writeFixture(t, zipFixture(t, []fixtureEntry{
+		{name: "xmlui-invoice-main/index.html", body: "<App/>"},
+		{name: "xmlui-invoice-main/Página.xmlui", body: "<Page/>"},
+	}))
+	if err := Unzip(archive, installDir); err != nil {
+		t.Fatal(err)
+	}
+	final, err := MoveIntoPlace(installDir, "xmlui-invoice", installDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != filepath.Join(installDir, "xmlui-invoice") {
+		t.Errorf("moved to %s", final)
+	}
+	checkTree(t, installDir, map[string]string{
+		"xmlui-invoice/index.html":   "<App/>",
+		"xmlui-invoice/Página.xmlui": "<Page/>",
+	})
+}
+
+func TestMoveIntoPlaceExisting(t *testing.T) {
+	parent := extractedApp(t, "new")
+	old := filepath.Join(parent, "xmlui-invoice")
+	os.MkdirAll(old, 0755)
+	os.WriteFile(filepath.Join(old, "index.html"), []byte("old"), 0644)
+
+	_, err := MoveIntoPlace(parent, "xmlui-invoice", parent, "")
+	if !errors.Is(err, ErrDestinationExists) {
+		t.Fatalf("got %v, want ErrDestinationExists", err)
+	}
+	var le *LayoutError
+	if !errors.As(err, &le) || le.Path != old {
+		t.Errorf("got %#v, want a LayoutError for %s", le, old)
+	}
+	checkTree(t, parent, map[string]string{
+		"xmlui-invoice/index.html":      "old",
+		"xmlui-invoice-main/index.html": "new",
+	})
+
+	Replace = true
+	t.Cleanup(func() { Replace = false })
+	if _, err := MoveIntoPlace(parent, "xmlui-invoice", parent, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, parent, map[string]string{"xmlui-invoice/index.html": "new"})
+}
+
+func TestMoveOrCopyMissing(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	err := MoveOrCopy(filepath.Join(dir, "missing"), dst)
+	var le *LayoutError
+	if !errors.As(err, &le) || le.Op != "move" || le.Path != dst {
+		t.Fatalf("got %v, want a LayoutError moving to %s", err, dst)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want it to wrap os.ErrNotExist", err)
+	}
+}
+
+// MoveOrCopy only copies across filesystems, which a test can't arrange, so
+// this checks the copy directly
+func TestCopyPreserving(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a"), 0644)
+	os.Symlink("sub/a.txt", filepath.Join(src, "link"))
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := copyPreserving(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dst, map[string]string{"sub/a.txt": "a"})
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err == nil && target != "sub/a.txt" {
+		t.Errorf("link points to %q, want sub/a.txt", target)
+	}
+}
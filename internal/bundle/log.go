@@ -0,0 +1,38 @@
+package bundle
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Level is how much progress output Logf and Detailf print. Errors,
+// warnings and the output a command exists to produce print at every level.
+type Level int
+
+const (
+	Quiet Level = iota
+	Normal
+	Verbose
+)
+
+// Verbosity is the current output level
+var Verbosity = Normal
+
+// Output is where Logf and Detailf print, e.g. stderr when stdout carries
+// machine-readable output
+var Output io.Writer = os.Stdout
+
+// Logf prints a line of progress, unless Verbosity is Quiet
+func Logf(format string, args ...any) {
+	if Verbosity >= Normal {
+		fmt.Fprintf(Output, format+"\n", args...)
+	}
+}
+
+// Detailf prints a line of detail only when Verbosity is Verbose
+func Detailf(format string, args ...any) {
+	if Verbosity >= Verbose {
+		fmt.Fprintf(Output, format+"\n", args...)
+	}
+}
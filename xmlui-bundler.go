@@ -1,407 +1,4018 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/jonudell/xmlui-bundler/internal/bundle"
 )
 
 const (
-	repoName     = "xmlui-invoice"
-	branchName   = "main"
-	appZipURL    = "https://codeload.github.com/jonudell/" + repoName + "/zip/refs/heads/" + branchName
-	xmluiRepoZip = "https://codeload.github.com/xmlui-com/xmlui/zip/refs/heads/main"
+	defaultAppOwner  = "jonudell"
+	defaultAppRepo   = "xmlui-invoice"
+	defaultAppBranch = "main"
+	xmluiRepoZip     = "https://codeload.github.com/xmlui-com/xmlui/zip/refs/heads/main"
+
+	defaultMCPVersion    = "v1.0.0"
+	defaultServerVersion = "v1.0.0"
 )
 
-func getPlatformSpecificMCPURL() string {
-	baseURL := "https://github.com/jonudell/xmlui-mcp/releases/download/v1.0.0/"
-	arch := runtime.GOARCH
-	switch runtime.GOOS {
-	case "darwin":
-		if arch == "arm64" {
-			return baseURL + "xmlui-mcp-mac-arm.tar.gz"
-		}
-		return baseURL + "xmlui-mcp-mac-amd.tar.gz"
-	case "linux":
-		return baseURL + "xmlui-mcp-linux-amd64.zip"
-	case "windows":
-		return baseURL + "xmlui-mcp-windows-amd64.zip"
+// options holds the command-line configuration.
+type options struct {
+	componentsOnlyChanged bool
+	mcpVersion            string
+	serverVersion         string
+	listContents          string
+	componentsStripPrefix string
+	appSubdir             string
+	showSize              bool
+	componentsFormat      string
+	doctor                bool
+	appCommit             string
+	appOwner              string
+	appRepo               string
+	appBranch             string
+	json                  bool
+	linkBin               string
+	prune                 stringList
+	cdn                   string
+	mirror                string
+	skipApp               bool
+	skipComponents        bool
+	skipMCP               bool
+	skipServer            bool
+	outputLayout          string
+	componentsRef         string
+	verbose               bool
+	failOnWarning         bool
+	appArchiveFormat      string
+	interactive           bool
+	replaceBinariesOnly   bool
+	allowRoot             bool
+	perHostConcurrency    int
+	parallel              int
+	maxExtractErrors      int
+	componentsVerify      string
+	caFile                string
+	printLayout           bool
+	componentsInto        string
+	noExecBit             bool
+	componentsOnly        bool
+	appOnly               bool
+	only                  string
+	verifyOnlyDownloads   bool
+	installDir            string
+	reproducible          bool
+	summaryJSON           bool
+	showVersion           bool
+	fromDir               string
+	strict                bool
+	selfUpdate            bool
+	emitDigest            bool
+	dryRun                bool
+	completion            string
+	keepOnFailure         bool
+	trace                 string
+	downloadTimeout       time.Duration
+	since                 time.Duration
+	noReadme              bool
+	readmeTemplate        string
+	noCache               bool
+	diskHeadroom          float64
+	quiet                 bool
+	uninstall             bool
+	yes                   bool
+	force                 bool
+}
+
+// stringList is a flag.Value that collects repeated string flags
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// defaultPrune lists directories in the component source that aren't needed at runtime
+var defaultPrune = []string{"node_modules", "__tests__", "__snapshots__"}
+
+var opts options
+
+// trustCAFile adds the PEM certificates in path to the system roots used by
+// bundle.Client
+func trustCAFile(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	t := bundle.Client.Transport.(*http.Transport)
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.RootCAs = pool
+	return nil
+}
+
+// tracingTransport writes the timings and headers of each request, one entry
+// per hop of a redirect chain, to w for -trace
+type tracingTransport struct {
+	next http.RoundTripper
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The callbacks can run on the transport's own goroutines
+	var mu sync.Mutex
+	locked := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+	var dnsStart, connectStart, tlsStart time.Time
+	var dns, connect, handshake, firstByte time.Duration
+	reused := false
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { locked(func() { dnsStart = time.Now() }) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { locked(func() { dns = time.Since(dnsStart) }) },
+		ConnectStart:         func(string, string) { locked(func() { connectStart = time.Now() }) },
+		ConnectDone:          func(string, string, error) { locked(func() { connect = time.Since(connectStart) }) },
+		TLSHandshakeStart:    func() { locked(func() { tlsStart = time.Now() }) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { locked(func() { handshake = time.Since(tlsStart) }) },
+		GotConn:              func(info httptrace.GotConnInfo) { locked(func() { reused = info.Reused }) },
+		GotFirstResponseByte: func() { locked(func() { firstByte = time.Since(start) }) },
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	mu.Lock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\n", start.Format(time.RFC3339Nano), req.Method, redactURL(req.URL))
+	writeTraceHeaders(&b, "> ", req.Header)
+	if reused {
+		fmt.Fprintf(&b, "  reused connection, first byte %s\n", firstByte)
+	} else {
+		fmt.Fprintf(&b, "  dns %s, connect %s, tls %s, first byte %s\n", dns, connect, handshake, firstByte)
+	}
+	mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(&b, "  error: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "< %s %s\n", resp.Proto, resp.Status)
+		writeTraceHeaders(&b, "< ", resp.Header)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.w, b.String()+"\n")
+	return resp, err
+}
+
+// writeTraceHeaders writes headers in sorted order, redacting credentials
+func writeTraceHeaders(w io.Writer, prefix string, h http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		value := strings.Join(h[name], ", ")
+		switch name {
+		case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+			value = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+	}
+}
+
+// redactURL hides query parameters that carry credentials, such as the
+// signatures on the storage URLs release downloads redirect to
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	redacted := *u
+	query := u.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if strings.Contains(lower, "sig") || strings.Contains(lower, "token") || strings.Contains(lower, "credential") {
+			query.Set(key, "[redacted]")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+func parseFlags() {
+	flag.BoolVar(&opts.componentsOnlyChanged, "components-only-changed", false,
+		"only write component files whose content differs (by SHA-256) from the files already on disk, and remove files no longer in the new version")
+	flag.StringVar(&opts.mcpVersion, "mcp-version", envOr("XMLUI_MCP_VERSION", defaultMCPVersion),
+		"release tag of the MCP tools to install (default from XMLUI_MCP_VERSION)")
+	flag.StringVar(&opts.serverVersion, "server-version", envOr("XMLUI_SERVER_VERSION", defaultServerVersion),
+		"release tag of the test server to install (default from XMLUI_SERVER_VERSION)")
+	flag.StringVar(&opts.listContents, "list-contents", "", "print the entries of a local zip or tar.gz `archive` and exit")
+	flag.StringVar(&opts.componentsStripPrefix, "components-strip-prefix", "xmlui",
+		"directory in the XMLUI archive that contains src/components")
+	flag.StringVar(&opts.appSubdir, "app-subdir", "", "path within the app archive that holds the app (default: the archive root)")
+	flag.BoolVar(&opts.showSize, "show-size", false, "print the total installed size per component when done")
+	flag.StringVar(&opts.componentsFormat, "components-format", "auto",
+		"archive format of the XMLUI components download: zip, tar.gz, or auto to detect it")
+	flag.BoolVar(&opts.doctor, "doctor", false, "check the environment for common install problems and exit")
+	flag.BoolVar(&opts.showVersion, "version", false, "print the bundler's version and exit")
+	flag.BoolVar(&opts.selfUpdate, "self-update", false,
+		"replace this executable with the latest xmlui-bundler release for this platform, once its checksum is verified, and exit")
+	flag.StringVar(&opts.appCommit, "app-commit", "", "install the app at this git commit `sha` instead of the -app-branch branch")
+	flag.StringVar(&opts.appOwner, "app-owner", envOr("XMLUI_APP_OWNER", defaultAppOwner),
+		"GitHub `owner` of the app repo, e.g. for a fork (default from XMLUI_APP_OWNER)")
+	flag.StringVar(&opts.appRepo, "app-repo", envOr("XMLUI_APP_REPO", defaultAppRepo),
+		"`name` of the app repo on GitHub, which also names the app dir (default from XMLUI_APP_REPO)")
+	flag.StringVar(&opts.appBranch, "app-branch", envOr("XMLUI_APP_BRANCH", defaultAppBranch),
+		"`branch` of the app repo to install (default from XMLUI_APP_BRANCH)")
+	flag.BoolVar(&opts.json, "json", false,
+		"print progress as JSON lines on stdout, one per download, extraction and step, ending with a complete or error record (human output goes to stderr)")
+	flag.StringVar(&opts.linkBin, "link-bin", "", "link the MCP binaries into this `dir` (e.g. ~/.local/bin); copies on Windows; existing files not from an install are left alone unless -force")
+	flag.Var(&opts.prune, "prune", "also remove component source entries matching this `glob` after extraction (repeatable)")
+	flag.StringVar(&opts.cdn, "cdn", "", "try release assets from this mirror `base-url` first, falling back to GitHub")
+	flag.StringVar(&opts.fromDir, "from-dir", "",
+		"install from archives already downloaded into this `directory`, under the names GitHub gives them, without using the network")
+	flag.StringVar(&opts.mirror, "mirror", envOr("XMLUI_MIRROR_BASE", ""),
+		"download everything from this `base-url` instead of GitHub, at the same paths (default from XMLUI_MIRROR_BASE)")
+	flag.BoolVar(&opts.skipApp, "skip-app", false, "don't install the invoice app")
+	flag.BoolVar(&opts.skipComponents, "skip-components", false, "don't install the XMLUI components")
+	flag.BoolVar(&opts.skipMCP, "skip-mcp", false, "don't install the MCP tools")
+	flag.BoolVar(&opts.skipServer, "skip-server", false, "don't install the test server")
+	flag.StringVar(&opts.outputLayout, "output-layout", "nested",
+		"nested puts the MCP tools, docs and src under mcp/; flat puts them at the top of the install dir")
+	flag.StringVar(&opts.componentsRef, "components-ref", "refs/heads/main",
+		"git `ref` (branch, tag, or commit SHA) of the xmlui repo to take components from")
+	flag.BoolVar(&opts.verbose, "verbose", false,
+		"print extra detail, such as how platform assets were chosen, each extracted file and permission changes")
+	flag.BoolVar(&opts.quiet, "quiet", false, "print only warnings, errors and the final install location")
+	flag.BoolVar(&opts.failOnWarning, "fail-on-warning", false, "treat every warning as a fatal error")
+	flag.BoolVar(&opts.strict, "strict", false,
+		"fail, rather than warn, when a downloaded MCP or server executable is built for another OS or architecture")
+	flag.StringVar(&opts.appArchiveFormat, "app-archive-format", "auto",
+		"download the app as zip or tar.gz; auto takes the zip and extracts whatever arrives")
+	flag.BoolVar(&opts.interactive, "interactive", false, "offer a choice of recent releases for versions not given on the command line")
+	flag.BoolVar(&opts.replaceBinariesOnly, "replace-binaries-only", false,
+		"in an existing install, swap in new MCP and server executables and leave everything else alone")
+	flag.BoolVar(&opts.allowRoot, "allow-root", false, "allow installing as root")
+	flag.DurationVar(&opts.since, "since", 0,
+		"with -only, -replace-binaries-only or -install-components-only, do nothing if the install dir was last installed into less than this `duration` ago")
+	flag.IntVar(&opts.perHostConcurrency, "download-concurrency-per-host", 2,
+		"maximum simultaneous downloads from any one host")
+	flag.IntVar(&opts.parallel, "parallel", 3,
+		"download up to this many of the archives at once before installing them in order (1 downloads each as its step starts)")
+	flag.IntVar(&opts.maxExtractErrors, "max-extract-errors", 10, "how many extraction errors to list before summarizing the rest")
+	flag.StringVar(&opts.componentsVerify, "components-verify", "",
+		"check the installed components against an index `file` listing one required component per line (relative paths resolve against the app dir)")
+	flag.StringVar(&opts.caFile, "ca-file", envOr("XMLUI_CA_BUNDLE", ""),
+		"also trust the CA certificates in this PEM `file`, e.g. for an internal mirror or a TLS-intercepting proxy (default $XMLUI_CA_BUNDLE)")
+	flag.StringVar(&opts.caFile, "ca-bundle", envOr("XMLUI_CA_BUNDLE", ""), "alias for -ca-file: trust the CA certificates in this PEM `file`")
+	flag.BoolVar(&opts.printLayout, "print-layout", false, "print where each asset will be installed for the given flags and exit")
+	flag.StringVar(&opts.componentsInto, "components-into", "",
+		"also place the component source at this `path` relative to the app dir")
+	flag.BoolVar(&opts.noExecBit, "no-exec-bit", false,
+		"never set execute permissions (for volumes that forbid them); run scripts through sh instead")
+	flag.BoolVar(&opts.componentsOnly, "install-components-only", false,
+		"in an existing install, refresh just the XMLUI components and leave everything else alone")
+	flag.BoolVar(&opts.appOnly, "app-only", false, "install just the invoice app (same as skipping the components, MCP tools and server)")
+	flag.StringVar(&opts.only, "only", "",
+		"run just these comma-separated `steps` (app, components, mcp, server), keeping what earlier installs put in the install dir")
+	flag.BoolVar(&opts.verifyOnlyDownloads, "verify-only-downloads", false,
+		"download every asset for this platform, check its checksum, and exit without installing anything")
+	flag.StringVar(&opts.installDir, "install-dir", "", "install into this `directory` (created if missing) instead of the current one")
+	flag.BoolVar(&opts.reproducible, "reproducible", false,
+		"extract zip and tar.gz entries in sorted path order and keep archive mtimes (directories included), so identical assets give identical trees")
+	flag.BoolVar(&opts.summaryJSON, "summary-json", false,
+		"write summary.json (versions, platform, size, asset URLs) to the install dir after a successful install")
+	flag.BoolVar(&opts.emitDigest, "emit-digest", false,
+		"write "+digestName+" (a SHA-256 of every installed file's content, and one over them all) to the install dir, to compare installs")
+	flag.BoolVar(&opts.dryRun, "dry-run", false,
+		"print each download, extraction and move an install would do, without doing any of them")
+	flag.StringVar(&opts.completion, "completion", "", "print a completion script for `shell` (bash, zsh or fish) and exit")
+	flag.BoolVar(&opts.keepOnFailure, "keep-on-failure", false,
+		"leave a failed install's partial files and temporary directories in place for debugging")
+	flag.StringVar(&opts.trace, "trace", "",
+		"log timings (DNS, connect, TLS, first byte) and headers of every HTTP request to this `file`, with credentials redacted")
+	flag.DurationVar(&opts.downloadTimeout, "download-timeout", 5*time.Minute,
+		"give up on a single download, body included, after this long")
+	flag.BoolVar(&opts.noReadme, "no-readme", false, "don't write "+readmeName+" into the install dir")
+	flag.StringVar(&opts.readmeTemplate, "readme-template", "",
+		"write "+readmeName+" from this Go text/template `file` instead of the built-in one "+
+			"(fields: .InstallDir, .AppDir, .MCPDir, .MCPVersion, .ServerVersion, .Launch)")
+	flag.BoolVar(&opts.noCache, "no-cache", false,
+		"always download, ignoring and not updating the download cache in the user cache dir")
+	flag.Float64Var(&opts.diskHeadroom, "disk-headroom", 2,
+		"require this many times the download size in free space, on top of the downloads, for extracting them")
+	flag.BoolVar(&opts.uninstall, "uninstall", false,
+		"remove what earlier installs created in the install dir, as listed in its "+manifestName+", and exit")
+	flag.BoolVar(&opts.yes, "yes", false, "with -uninstall, delete without asking")
+	flag.BoolVar(&opts.force, "force", false,
+		"install over an earlier install in the install dir without asking, replacing its app directory; with -uninstall, delete without asking, "+
+			"and fall back to the standard layout's paths if there is no "+manifestName)
+	flag.Parse()
+}
+
+// checkFlags validates the flags and settles the ones implied by others
+func checkFlags() error {
+	if opts.appOnly {
+		if opts.skipApp || opts.componentsOnly || opts.replaceBinariesOnly {
+			return usagef("Invalid combination of flags: -app-only can't be used with -skip-app, -install-components-only or -replace-binaries-only")
+		}
+		opts.skipComponents, opts.skipMCP, opts.skipServer = true, true, true
+	}
+	if opts.only != "" {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, name := range []string{"app-only", "install-components-only", "replace-binaries-only", "skip-app", "skip-components", "skip-mcp", "skip-server"} {
+			if set[name] {
+				return usagef("Invalid combination of flags: -only can't be used with -%s", name)
+			}
+		}
+		selected := make(map[string]bool)
+		for _, step := range strings.Split(opts.only, ",") {
+			step = strings.TrimSpace(step)
+			switch step {
+			case "app", "components", "mcp", "server":
+				selected[step] = true
+			default:
+				return usagef("Invalid -only: unknown step %q (expected app, components, mcp or server)", step)
+			}
+		}
+		opts.skipApp, opts.skipComponents = !selected["app"], !selected["components"]
+		opts.skipMCP, opts.skipServer = !selected["mcp"], !selected["server"]
+	}
+	if err := checkArchiveFormat(opts.componentsFormat); err != nil {
+		return usagef("Invalid -components-format: %w", err)
+	}
+	if opts.noReadme && opts.readmeTemplate != "" {
+		return usagef("Invalid combination of flags: -no-readme can't be used with -readme-template")
+	}
+	if opts.readmeTemplate != "" {
+		// Render it once now so a bad field name fails before anything is downloaded
+		tmpl, err := loadReadmeTemplate()
+		if err == nil {
+			err = tmpl.Execute(io.Discard, readmeData{})
+		}
+		if err != nil {
+			return usagef("Invalid -readme-template: %w", err)
+		}
+	}
+	if opts.quiet && opts.verbose {
+		return usagef("Invalid combination of flags: -quiet can't be used with -verbose")
+	}
+	if opts.diskHeadroom < 0 {
+		return usagef("Invalid -disk-headroom: must not be negative")
+	}
+	if opts.downloadTimeout <= 0 {
+		return usagef("Invalid -download-timeout: must be positive")
+	}
+	if opts.perHostConcurrency < 1 {
+		return usagef("Invalid -download-concurrency-per-host: must be at least 1")
+	}
+	if opts.parallel < 1 {
+		return usagef("Invalid -parallel: must be at least 1")
+	}
+	if err := checkArchiveFormat(opts.appArchiveFormat); err != nil {
+		return usagef("Invalid -app-archive-format: %w", err)
+	}
+	if opts.outputLayout != "nested" && opts.outputLayout != "flat" {
+		return usagef("Invalid -output-layout: %q (expected nested or flat)", opts.outputLayout)
+	}
+	if opts.appCommit != "" && !bundle.IsCommitSHA(opts.appCommit) {
+		return usagef("Invalid -app-commit: %q is not a git commit SHA", opts.appCommit)
+	}
+	for _, f := range []struct{ name, value string }{{"app-owner", opts.appOwner}, {"app-repo", opts.appRepo}} {
+		if f.value == "" || strings.ContainsAny(f.value, "/\\") || f.value == "." || f.value == ".." {
+			return usagef("Invalid -%s: %q is not a GitHub name", f.name, f.value)
+		}
+	}
+	if opts.appBranch == "" {
+		return usagef("Invalid -app-branch: must not be empty")
+	}
+	if opts.mirror != "" {
+		if u, err := url.Parse(opts.mirror); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return usagef("Invalid -mirror: %q is not an http(s) URL", opts.mirror)
+		}
+		if opts.cdn != "" {
+			return usagef("Invalid combination of flags: -mirror can't be used with -cdn")
+		}
+	}
+	if opts.fromDir != "" {
+		if info, err := os.Stat(opts.fromDir); err != nil || !info.IsDir() {
+			return usagef("Invalid -from-dir: %s is not a directory", opts.fromDir)
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, name := range []string{"mirror", "cdn", "interactive", "verify-only-downloads", "self-update"} {
+			if set[name] {
+				return usagef("Invalid combination of flags: -from-dir can't be used with -%s", name)
+			}
+		}
+	}
+	if opts.since < 0 {
+		return usagef("Invalid -since: must not be negative")
+	}
+	if opts.since > 0 && opts.only == "" && !opts.replaceBinariesOnly && !opts.componentsOnly {
+		return usagef("Invalid combination of flags: -since only applies to updates (-only, -replace-binaries-only or -install-components-only)")
+	}
+	if opts.componentsOnly && (opts.replaceBinariesOnly || opts.skipComponents) {
+		return usagef("Invalid combination of flags: -install-components-only can't be used with -replace-binaries-only or -skip-components")
+	}
+	return nil
+}
+
+// completionChoices lists the fixed values of flags that take one
+var completionChoices = map[string][]string{
+	"app-archive-format": {"zip", "tar.gz", "auto"},
+	"components-format":  {"zip", "tar.gz", "auto"},
+	"output-layout":      {"nested", "flat"},
+	"completion":         {"bash", "zsh", "fish"},
+}
+
+// completionArg says what a flag's value completes to: "choices" (from
+// completionChoices), "dir", "file", "" for free text, or "none" for a
+// boolean flag. Paths are recognized by the value name in the usage text.
+func completionArg(f *flag.Flag) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return "none"
+	}
+	if _, ok := completionChoices[f.Name]; ok {
+		return "choices"
+	}
+	switch name, _ := flag.UnquoteUsage(f); name {
+	case "dir", "directory":
+		return "dir"
+	case "file", "archive":
+		return "file"
+	}
+	return ""
+}
+
+// writeCompletion prints a completion script covering every flag for shell
+func writeCompletion(w io.Writer, shell string) error {
+	const cmd = "xmlui-bundler"
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+
+	switch shell {
+	case "bash":
+		var names, dirs, files, free []string
+		var choices strings.Builder
+		for _, f := range flags {
+			names = append(names, "-"+f.Name)
+			switch completionArg(f) {
+			case "choices":
+				fmt.Fprintf(&choices, "        -%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n",
+					f.Name, strings.Join(completionChoices[f.Name], " "))
+			case "dir":
+				dirs = append(dirs, "-"+f.Name)
+			case "file":
+				files = append(files, "-"+f.Name)
+			case "":
+				free = append(free, "-"+f.Name)
+			}
+		}
+		fmt.Fprintf(w, "_xmlui_bundler() {\n")
+		fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+		fmt.Fprintf(w, "    case \"$prev\" in\n%s", choices.String())
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", strings.Join(dirs, "|"))
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(files, "|"))
+		fmt.Fprintf(w, "        %s) return ;;\n", strings.Join(free, "|"))
+		fmt.Fprintf(w, "    esac\n")
+		fmt.Fprintf(w, "    COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+		fmt.Fprintf(w, "}\ncomplete -F _xmlui_bundler %s\n", cmd)
+	case "zsh":
+		escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+		fmt.Fprintf(w, "#compdef %s\n\n_arguments \\\n", cmd)
+		for _, f := range flags {
+			name, usage := flag.UnquoteUsage(f)
+			spec := fmt.Sprintf("-%s[%s]", f.Name, escape.Replace(usage))
+			switch completionArg(f) {
+			case "choices":
+				spec += ":" + name + ":(" + strings.Join(completionChoices[f.Name], " ") + ")"
+			case "dir":
+				spec += ":" + name + ":_files -/"
+			case "file":
+				spec += ":" + name + ":_files"
+			case "":
+				spec += ":" + name + ": "
+			}
+			fmt.Fprintf(w, "  '%s' \\\n", spec)
+		}
+		fmt.Fprintln(w)
+	case "fish":
+		escape := strings.NewReplacer("'", "\\'")
+		for _, f := range flags {
+			_, usage := flag.UnquoteUsage(f)
+			line := fmt.Sprintf("complete -c %s -o %s -d '%s'", cmd, f.Name, escape.Replace(usage))
+			switch completionArg(f) {
+			case "choices":
+				line += " -x -a '" + strings.Join(completionChoices[f.Name], " ") + "'"
+			case "dir":
+				line += " -x -a '(__fish_complete_directories)'"
+			case "file":
+				line += " -r -F"
+			case "":
+				line += " -x"
+			}
+			fmt.Fprintln(w, line)
+		}
 	default:
-		return baseURL + "xmlui-mcp-mac-arm.tar.gz"
+		return fmt.Errorf("unsupported shell %q (expected bash, zsh or fish)", shell)
+	}
+	return nil
+}
+
+// resolveInstallDir returns the absolute -install-dir, or the current
+// directory when it isn't given
+func resolveInstallDir() (string, error) {
+	if opts.installDir == "" {
+		return os.Getwd()
+	}
+	return filepath.Abs(opts.installDir)
+}
+
+// checkWritable makes sure files can be created in dir, so a read-only
+// target fails before anything is downloaded
+func checkWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".xmlui-write-test-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// envOr returns the environment variable key, or fallback when it's unset
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// mirrorURL moves a GitHub or codeload URL onto the -mirror host, keeping
+// its path, or returns it unchanged when there's no mirror. Mirrored URLs
+// aren't GitHub hosts, so no token is sent to them.
+func mirrorURL(rawURL string) string {
+	if opts.mirror == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return strings.TrimSuffix(opts.mirror, "/") + u.Path
+}
+
+// xmluiArchiveURL returns the codeload URL of the xmlui repo at -components-ref
+func xmluiArchiveURL() string {
+	kind := "zip"
+	if opts.componentsFormat == "tar.gz" {
+		kind = "tar.gz"
+	}
+	return mirrorURL("https://codeload.github.com/xmlui-com/xmlui/" + kind + "/" + opts.componentsRef)
+}
+
+// appArchiveURL returns the codeload URL of -app-owner/-app-repo in
+// -app-archive-format (zip for auto), at -app-branch or pinned to a commit
+// when one was given
+func appArchiveURL() string {
+	kind := "zip"
+	if opts.appArchiveFormat == "tar.gz" {
+		kind = "tar.gz"
+	}
+	ref := "refs/heads/" + opts.appBranch
+	if opts.appCommit != "" {
+		// codeload names the top-level folder <repo>-<sha>, which bundle.MoveIntoPlace matches
+		ref = opts.appCommit
+	}
+	return mirrorURL("https://codeload.github.com/" + opts.appOwner + "/" + opts.appRepo + "/" + kind + "/" + ref)
+}
+
+// releaseAssets names a platform's MCP tools and test server release
+// assets. Partial is set for platforms that not every release has a build
+// for, so the assets are checked for before downloading.
+type releaseAssets struct {
+	mcp, server string
+	partial     bool
+}
+
+// platformAssets lists the release assets for each GOOS/GOARCH
+var platformAssets = map[string]releaseAssets{
+	"darwin/arm64":  {"xmlui-mcp-mac-arm.tar.gz", "xmlui-test-server-mac-arm.tar.gz", false},
+	"darwin/amd64":  {"xmlui-mcp-mac-amd.tar.gz", "xmlui-test-server-mac-amd.tar.gz", false},
+	"linux/amd64":   {"xmlui-mcp-linux-amd64.zip", "xmlui-test-server-linux-amd64.tar.gz", false},
+	"linux/arm64":   {"xmlui-mcp-linux-arm64.zip", "xmlui-test-server-linux-arm64.tar.gz", true},
+	"windows/amd64": {"xmlui-mcp-windows-amd64.zip", "xmlui-test-server-windows-amd64.zip", false},
+	"windows/arm64": {"xmlui-mcp-windows-arm64.zip", "xmlui-test-server-windows-arm64.zip", true},
+}
+
+// checkPlatform refuses to install the MCP tools or test server on a
+// platform they aren't published for, rather than fetching another
+// platform's binaries that would only fail when run
+func checkPlatform() error {
+	if opts.skipMCP && opts.skipServer {
+		return nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if _, ok := platformAssets[platform]; ok {
+		return nil
+	}
+	return fmt.Errorf("no MCP tools or test server build is published for %s (supported: %s); "+
+		"pass -skip-mcp and -skip-server to install just the app and components",
+		platform, strings.Join(slices.Sorted(maps.Keys(platformAssets)), ", "))
+}
+
+// getPlatformSpecificMCPURL returns the MCP tools asset for this platform,
+// which checkPlatform has already vetted
+func getPlatformSpecificMCPURL(version string) string {
+	return mirrorURL("https://github.com/jonudell/xmlui-mcp/releases/download/" + version + "/" +
+		platformAssets[runtime.GOOS+"/"+runtime.GOARCH].mcp)
+}
+
+// getPlatformSpecificServerURL returns the test server asset for this
+// platform, which checkPlatform has already vetted
+func getPlatformSpecificServerURL(version string) string {
+	return mirrorURL("https://github.com/JonUdell/xmlui-test-server/releases/download/" + version + "/" +
+		platformAssets[runtime.GOOS+"/"+runtime.GOARCH].server)
+}
+
+// version is the bundler's release tag, set when a release is built with
+// -ldflags "-X main.version=<tag>"; local builds are "dev"
+var version = "dev"
+
+// The bundler's own releases, which -self-update installs from
+const (
+	bundlerOwner = "JonUdell"
+	bundlerRepo  = "xmlui-bundler"
+)
+
+// getPlatformSpecificBundlerURL returns the bundler executable released for
+// this platform under tag
+func getPlatformSpecificBundlerURL(tag string) string {
+	name := "xmlui-bundler-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return mirrorURL("https://github.com/" + bundlerOwner + "/" + bundlerRepo + "/releases/download/" + tag + "/" + name)
+}
+
+// newerVersion reports whether release tag a is newer than b, comparing the
+// dot-separated numbers after an optional v (v1.10.0 is newer than v1.9.2)
+func newerVersion(a, b string) bool {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			fmt.Sscan(as[i], &x)
+		}
+		if i < len(bs) {
+			fmt.Sscan(bs[i], &y)
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// selfUpdate replaces the running executable with the latest release for
+// this platform, when that's newer. The download has to match the checksum
+// published with it, and is staged next to the executable so the final
+// rename is atomic. Windows won't let a running executable be replaced, so
+// there the new one is left beside it as xmlui-bundler.new.
+func selfUpdate() error {
+	w := bundle.Output
+	// A local build has no version to compare, and may well be newer than
+	// any release
+	if version == "dev" && !opts.force {
+		return errors.New("this is a development build, not a release; pass -force to replace it with the latest release anyway")
+	}
+	latest, err := latestRelease(bundlerOwner, bundlerRepo)
+	if err != nil {
+		return fmt.Errorf("could not find the latest release: %w", err)
+	}
+	if version != "dev" && !newerVersion(latest, version) {
+		fmt.Fprintf(w, "xmlui-bundler %s is up to date (latest release: %s)\n", version, latest)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if err := checkWritable(filepath.Dir(exe)); err != nil {
+		return fmt.Errorf("can't write to %s, where the bundler is installed: %w", filepath.Dir(exe), err)
+	}
+
+	url := getPlatformSpecificBundlerURL(latest)
+	expected, err := publishedChecksum(url)
+	if err != nil {
+		return fmt.Errorf("could not fetch the checksum for %s: %w", latest, err)
+	}
+	if expected == "" {
+		return fmt.Errorf("no checksum is published for %s, so it can't be verified", url)
+	}
+	bundle.Dir = filepath.Dir(exe)
+	staged, err := bundle.DownloadWithRetry(url, "xmlui-bundler "+latest, downloadAttempts)
+	if err != nil {
+		return err
+	}
+	defer bundle.RemoveScratch(staged)
+	if err := bundle.VerifyChecksum(staged, expected); err != nil {
+		bundle.Evict(url)
+		return err
+	}
+	if err := os.Chmod(staged, 0755); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		next := filepath.Join(filepath.Dir(exe), "xmlui-bundler.new")
+		if err := os.Rename(staged, next); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Downloaded xmlui-bundler %s to %s\n", latest, next)
+		fmt.Fprintln(w, "Windows can't replace a running program, so once this exits run:")
+		fmt.Fprintf(w, "  move /y \"%s\" \"%s\"\n", next, exe)
+		return nil
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "✓ Updated xmlui-bundler %s to %s (%s)\n", version, latest, exe)
+	return nil
+}
+
+// installError is a failure that stops the install at the given step (0
+// for the checks before the first). Kind is a coarse category (network, auth,
+// extract, filesystem, config) for tools that wrap the bundler; with -json it
+// is emitted as a final machine-readable record.
+type installError struct {
+	step int
+	kind string
+	msg  string
+	err  error
+}
+
+func (e *installError) Error() string {
+	if e.step == 0 {
+		return fmt.Sprintf("%s: %v", e.msg, e.err)
+	}
+	return fmt.Sprintf("step %d: %s: %v", e.step, e.msg, e.err)
+}
+
+func (e *installError) Unwrap() error { return e.err }
+
+// fail returns the error that stops the install at step
+func fail(step int, kind, msg string, err error) error {
+	if errors.Is(err, bundle.ErrAuthFailed) {
+		kind = "auth"
+	}
+	return &installError{step: step, kind: kind, msg: msg, err: err}
+}
+
+// exitError is an error that ends the run with its own exit status: 2 for
+// bad flags, or 1 for a check that failed and already said why (err nil)
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// usagef returns the exit status 2 error for an invalid flag
+func usagef(format string, args ...any) error {
+	return &exitError{code: 2, err: fmt.Errorf(format, args...)}
+}
+
+// exitStatus reports the error run returned, rolling back a failed install
+// first, and returns the status to exit with
+func exitStatus(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		switch {
+		case ee.err == nil:
+		case opts.json:
+			// Keep stdout to JSON for whatever is parsing it
+			fmt.Fprintln(os.Stderr, ee.err)
+			emit(progressEvent{Event: "error", Kind: "config", Phase: "config", Status: "error", Message: ee.err.Error()})
+		default:
+			fmt.Println(ee.err)
+		}
+		return ee.code
+	}
+	ie := &installError{kind: "config", msg: "Install failed", err: err}
+	errors.As(err, &ie)
+
+	if !opts.keepOnFailure {
+		bundle.RemoveAllScratch()
+		rollback()
+	}
+	if bundle.Context.Err() != nil {
+		// Interrupted: the signal handler has already said so
+		return 130
+	}
+	if !opts.json {
+		fmt.Println(ie.msg+":", ie.err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, ie.msg+":", ie.err)
+	phase := ie.kind
+	switch ie.kind {
+	case "network", "auth":
+		phase = "download"
+	}
+	currentStep = ie.step
+	emit(progressEvent{Event: "error", Kind: ie.kind, Phase: phase, Status: "error", Message: fmt.Sprintf("%s: %v", ie.msg, ie.err)})
+	return 1
+}
+
+// explainAssetChoice prints, under -verbose, which platform asset was picked
+// and why, calling out when the URL builders fell back to a guess
+func explainAssetChoice(what, url, override string) {
+	bundle.Detailf("  Platform: %s/%s", runtime.GOOS, runtime.GOARCH)
+	if override != "" {
+		bundle.Detailf("  Override: %s", override)
+	}
+	bundle.Detailf("  Selected %s asset: %s", what, path.Base(url))
+}
+
+// currentStep is the install step in progress, for warnings raised deep inside it
+var currentStep int
+
+// totalSteps counts the four downloads and organizing the layout. The
+// steps keep these numbers internally; what's shown counts only the ones
+// that run.
+const totalSteps = 5
+
+// stepSkipped reports whether a -skip flag turns off the given step
+func stepSkipped(step int) bool {
+	switch step {
+	case 1:
+		return opts.skipApp
+	case 2:
+		return opts.skipComponents
+	case 3:
+		return opts.skipMCP
+	case 4:
+		return opts.skipServer
+	}
+	return false
+}
+
+// stepNumber returns step's place among the steps that will run, or 0 for
+// a skipped step or the checks before the first
+func stepNumber(step int) int {
+	if step == 0 || stepSkipped(step) {
+		return 0
+	}
+	n := 0
+	for s := 1; s <= step; s++ {
+		if !stepSkipped(s) {
+			n++
+		}
+	}
+	return n
+}
+
+// skippedBy names the flag that turned a step off, for skipFlag's step
+func skippedBy(skipFlag string) string {
+	switch {
+	case opts.appOnly:
+		return "-app-only"
+	case opts.only != "":
+		return "-only " + opts.only
+	}
+	return "-" + skipFlag
+}
+
+// stepHeading labels a step that will run as "Step N/total: what"
+func stepHeading(step int, what string) string {
+	return fmt.Sprintf("Step %d/%d: %s", stepNumber(step), stepNumber(totalSteps), what)
+}
+
+// progressEvent is one line of -json output. Event and Kind are only set on
+// the error record, which kept them from before the progress events existed.
+type progressEvent struct {
+	Event   string `json:"event,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Step    int    `json:"step"`
+	Total   int    `json:"total"`
+	Phase   string `json:"phase"`
+	URL     string `json:"url,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+var emitMu sync.Mutex
+
+// emit writes a progress event for the current step to stdout under -json
+func emit(e progressEvent) {
+	if !opts.json {
+		return
+	}
+	e.Step, e.Total = stepNumber(currentStep), stepNumber(totalSteps)
+	if e.Status == "" {
+		e.Status = "ok"
+	}
+	line, _ := json.Marshal(e)
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	fmt.Println(string(line))
+}
+
+// finish reports where the install went: as the last line of output, or
+// as the final event under -json
+func finish(installDir string) {
+	if opts.json {
+		emit(progressEvent{Phase: "complete", Dir: installDir})
+		return
+	}
+	fmt.Printf("\nInstall location: %s\n", installDir)
+}
+
+// failedWarning holds the first warning under -fail-on-warning, which
+// fails the step it was raised in once the step returns
+var failedWarning struct {
+	sync.Mutex
+	err error
+}
+
+// warnf reports a condition that degrades the install without stopping it,
+// or stops it under -fail-on-warning
+func warnf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if opts.failOnWarning {
+		failedWarning.Lock()
+		defer failedWarning.Unlock()
+		if failedWarning.err == nil {
+			failedWarning.err = fail(currentStep, "warning", "Warning treated as error (-fail-on-warning)", errors.New(msg))
+		}
+		return
+	}
+	fmt.Fprintln(bundle.Output, "Warning:", msg)
+}
+
+// warningError returns the failure for the first warning under
+// -fail-on-warning, if there was one
+func warningError() error {
+	failedWarning.Lock()
+	defer failedWarning.Unlock()
+	return failedWarning.err
+}
+
+// runStep runs an install step, failing it if it raised a warning under
+// -fail-on-warning
+func runStep(install func(*layout) error, l *layout) error {
+	if err := install(l); err != nil {
+		return err
+	}
+	return warningError()
+}
+
+// recentReleases returns the tags of the newest releases of a GitHub repo,
+// newest first
+func recentReleases(owner, repo string, n int) ([]string, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases?per_page=%d", owner, repo, n)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	bundle.Authorize(req)
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %s for URL: %s", resp.Status, url)
+	}
+	var releases []struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, r := range releases {
+		tags = append(tags, r.TagName)
+	}
+	return tags, nil
+}
+
+// latestRelease returns the tag of the newest release of a GitHub repo that
+// isn't a draft or prerelease
+func latestRelease(owner, repo string) (string, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", owner, repo)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	bundle.Authorize(req)
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request failed: %s for URL: %s", resp.Status, url)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return release.TagName, nil
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// pickVersion lets the user choose one of the recent releases of owner/repo,
+// defaulting to the newest. It returns fallback if releases can't be listed.
+func pickVersion(what, owner, repo, fallback string) string {
+	w := bundle.Output
+	tags, err := recentReleases(owner, repo, 5)
+	if err != nil || len(tags) == 0 {
+		fmt.Fprintf(w, "Could not list %s releases (%v), using %s\n", what, err, fallback)
+		return fallback
+	}
+	fmt.Fprintf(w, "Available %s releases:\n", what)
+	for i, tag := range tags {
+		latest := ""
+		if i == 0 {
+			latest = " (latest)"
+		}
+		fmt.Fprintf(w, "  %d) %s%s\n", i+1, tag, latest)
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(w, "Choose a release [1]: ")
+		line, err := in.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return tags[0]
+		}
+		var choice int
+		if _, scanErr := fmt.Sscan(line, &choice); scanErr == nil && choice >= 1 && choice <= len(tags) {
+			return tags[choice-1]
+		}
+		if err != nil {
+			return tags[0]
+		}
+		fmt.Fprintf(w, "Please enter a number from 1 to %d\n", len(tags))
+	}
+}
+
+// assetSize asks the server for the size of the archive at url without
+// downloading it, returning -1 if it doesn't say (codeload archives are
+// generated as they're sent)
+func assetSize(url string) int64 {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return -1
+	}
+	bundle.Authorize(req)
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// checkExistingInstall looks for what an earlier install, or an interrupted
+// one, left where this one is about to write: the app dir, mcp/ and the
+// xmlui-source scratch dir. Mixing into those fails confusingly halfway
+// through, so it lists what it found and asks before going on, or fails
+// when it can't ask (-json, or no terminal). With -force, or a yes, the
+// install goes ahead: the app dir is replaced and mcp/ updated in place.
+// Under -only mcp/ is expected, so just the app dir counts.
+func checkExistingInstall(l *layout) error {
+	var found []string
+	check := func(dir string) {
+		if _, err := os.Lstat(dir); err == nil {
+			found = append(found, dir)
+		}
+	}
+	if !opts.skipApp {
+		check(l.appDir)
+	}
+	if opts.only == "" && l.mcpDir != l.installDir && (!opts.skipComponents || !opts.skipMCP) {
+		check(l.mcpDir)
+	}
+	stale := filepath.Join(l.installDir, "xmlui-source")
+	check(stale)
+	if len(found) == 0 {
+		return nil
+	}
+
+	list := "  " + strings.Join(found, "\n  ")
+	if !opts.force {
+		if opts.json || !isTerminal(os.Stdin) {
+			return fail(0, "config", "Install directory is not empty",
+				fmt.Errorf("found\n%s\nremove them, pass -force to install over them, or choose another -install-dir", list))
+		}
+		fmt.Printf("%s already holds:\n%s\n", l.installDir, list)
+		fmt.Print("Install over them? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return &exitError{code: 1, err: errors.New("Nothing installed.")}
+		}
+		bundle.Replace = true
+	} else {
+		bundle.Logf("Installing over what %s already holds (-force):\n%s", l.installDir, list)
+	}
+	// Only an interrupted run leaves xmlui-source, and extracting over it
+	// would leave two source trees to choose from
+	os.RemoveAll(stale)
+	return nil
+}
+
+// checkDiskSpace makes sure the install volume can hold the planned downloads
+// plus -disk-headroom times as much again for extracting them, so a small
+// disk fails up front instead of filling halfway through an extraction
+func checkDiskSpace(dir string) error {
+	free, err := bundle.FreeSpace(dir)
+	if err != nil {
+		warnf("Could not check free disk space: %v", err)
+		return nil
+	}
+	var total int64
+	for _, a := range plannedAssets() {
+		var size int64
+		if opts.fromDir != "" {
+			size = -1
+			if info, err := os.Stat(filepath.Join(opts.fromDir, a.local)); err == nil {
+				size = info.Size()
+			}
+		} else {
+			size = assetSize(a.url)
+		}
+		if size < 0 {
+			size = a.approx
+		}
+		total += size
+	}
+	need := uint64(float64(total) * (1 + opts.diskHeadroom))
+	if need > free {
+		return fmt.Errorf("need %d MB, have %d MB free on the volume holding %s (lower -disk-headroom if the archives expand less)",
+			need>>20, free>>20, dir)
+	}
+	return nil
+}
+
+// assetExists checks that a release asset is published at url without downloading it
+func assetExists(url string) error {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	bundle.Authorize(req)
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("asset not found: %s", url)
+	}
+	// A 202 means the asset exists but is still processing; the download retries
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("request failed: %s for URL: %s", resp.Status, url)
+	}
+	return nil
+}
+
+// downloadAttempts is how many times bundle.DownloadWithRetry tries before giving up
+const downloadAttempts = 5
+
+// cacheDir returns the download cache directory, or "" when there is none
+// (-no-cache, or no user cache dir on this system)
+func cacheDir() string {
+	if opts.noCache {
+		return ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "xmlui-bundler")
+}
+
+// cdnURL rewrites a GitHub release asset URL onto the -cdn mirror, keeping the
+// owner/repo/releases/download/... path. It returns "" if there's no mirror or
+// the URL isn't a release asset (codeload archives are generated on demand).
+func cdnURL(url string) string {
+	const github = "https://github.com/"
+	if opts.cdn == "" || !strings.HasPrefix(url, github) || !strings.Contains(url, "/releases/download/") {
+		return ""
+	}
+	return strings.TrimSuffix(opts.cdn, "/") + "/" + strings.TrimPrefix(url, github)
+}
+
+// downloadAsset downloads a release asset, trying the -cdn mirror first, and
+// checks it against the checksum published on GitHub next to it. A CDN copy
+// that fails to download or to verify is dropped in favor of GitHub's.
+func downloadAsset(url, filename string) (string, error) {
+	expected, err := publishedChecksum(url)
+	switch {
+	case err != nil:
+		warnf("Could not fetch the checksum for %s: %v", filename, err)
+	case expected == "":
+		// Older releases were published without checksums
+		warnf("No checksum published for %s, skipping verification", filename)
+	}
+
+	if mirror := cdnURL(url); mirror != "" {
+		archive, err := bundle.Download(mirror, filename)
+		if err == nil {
+			err = verifyAsset(archive, mirror, expected)
+		}
+		if err == nil {
+			return archive, nil
+		}
+		bundle.Logf("  CDN copy failed (%v), falling back to GitHub", err)
+	}
+	archive, err := bundle.DownloadWithRetry(url, filename, downloadAttempts)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyAsset(archive, url, expected); err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	return archive, nil
+}
+
+// verifyAsset checks the archive downloaded from url against the expected
+// digest, if one was published. On a mismatch it removes the archive and
+// evicts url, so the same bad bytes aren't served from the cache next time.
+func verifyAsset(archive, url, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if err := bundle.VerifyChecksum(archive, expected); err != nil {
+		bundle.RemoveScratch(archive)
+		bundle.Evict(url)
+		return err
+	}
+	bundle.Logf("  Checksum verified")
+	return nil
+}
+
+// publishedChecksum fetches the <url>.sha256 file released alongside an asset
+// and returns the digest in it, or "" if the release has none
+func publishedChecksum(url string) (string, error) {
+	req, err := http.NewRequest("GET", url+".sha256", nil)
+	if err != nil {
+		return "", err
+	}
+	bundle.Authorize(req)
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request failed: %s for URL: %s.sha256", resp.Status, url)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	// sha256sum format: "<digest>  <filename>"
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file: %s.sha256", url)
+	}
+	return fields[0], nil
+}
+
+// newExtractReporter returns a bundle.Progress that prints throughput every
+// couple of seconds, so only slow extractions (network filesystems, mostly)
+// show anything unless -verbose is given
+func newExtractReporter() func(int64, time.Duration, bool) {
+	const every = 2 * time.Second
+	var last time.Duration
+	rate := func(written int64, elapsed time.Duration) string {
+		if elapsed <= 0 {
+			return humanSize(written) + "/s"
+		}
+		return humanSize(int64(float64(written)/elapsed.Seconds())) + "/s"
+	}
+	return func(written int64, elapsed time.Duration, done bool) {
+		if done {
+			emit(progressEvent{Phase: "extract", Bytes: written})
+			if bundle.Verbosity == bundle.Verbose || elapsed >= every {
+				bundle.Logf("  Extracted %s in %s (%s)", humanSize(written), elapsed.Round(time.Millisecond), rate(written, elapsed))
+			}
+			last = 0
+			return
+		}
+		if elapsed-last >= every {
+			last = elapsed
+			bundle.Logf("  Extracting... %s so far (%s)", humanSize(written), rate(written, elapsed))
+		}
+	}
+}
+
+// newDownloadReporter is the bundle.DownloadProgress that shows a slow
+// download isn't hung: on a terminal, a line redrawn twice a second with the
+// percentage, speed and ETA; otherwise the same as a plain line every ten
+// seconds. Quick downloads finish before anything is shown.
+func newDownloadReporter(url string, size int64) func(int64, time.Duration, bool) {
+	tty := bundle.Output == os.Stdout && isTerminal(os.Stdout)
+	what := path.Base(url)
+	for _, a := range plannedAssets() {
+		if a.url == url {
+			what = a.what
+		}
+	}
+	every := 10 * time.Second
+	if tty {
+		every = 500 * time.Millisecond
+	}
+	var last time.Duration
+	var lastReceived int64
+	shown := false
+	return func(received int64, elapsed time.Duration, done bool) {
+		if bundle.Verbosity == bundle.Quiet {
+			return
+		}
+		if done {
+			if shown && tty {
+				// Make way for the "Downloaded" line
+				fmt.Fprint(bundle.Output, "\r\033[K")
+			}
+			return
+		}
+		if elapsed-last < every {
+			return
+		}
+		// Speed over the last interval, so it follows the connection as it changes
+		speed := float64(received-lastReceived) / (elapsed - last).Seconds()
+		last, lastReceived = elapsed, received
+		line := humanSize(received)
+		if size > 0 {
+			line += fmt.Sprintf(" of %s (%d%%)", humanSize(size), received*100/size)
+		}
+		line += " at " + humanSize(int64(speed)) + "/s"
+		if size > 0 && speed > 0 {
+			eta := time.Duration(float64(size-received) / speed * float64(time.Second))
+			line += ", ETA " + eta.Round(time.Second).String()
+		}
+		switch {
+		case tty:
+			fmt.Fprintf(bundle.Output, "\r  %s\033[K", line)
+			shown = true
+		case prefetching:
+			bundle.Logf("  %s: %s", what, line)
+		default:
+			bundle.Logf("  %s", line)
+		}
+	}
+}
+
+// checkArchiveFormat validates an archive format flag value
+func checkArchiveFormat(format string) error {
+	switch format {
+	case "zip", "tar.gz", "auto":
+		return nil
+	}
+	return fmt.Errorf("unknown archive format %q (expected zip, tar.gz, or auto)", format)
+}
+
+// listArchive prints each entry of an archive without extracting it, flagging
+// entries that would land outside the destination directory
+func listArchive(archive string, w io.Writer) error {
+	return bundle.Walk(archive, func(name string, size int64, mode os.FileMode) {
+		note := ""
+		if _, err := bundle.SanitizeExtractPath(".", name); err != nil {
+			note = "  (outside destination!)"
+		}
+		fmt.Fprintf(w, "%s %12d  %s%s\n", mode, size, name, note)
+	})
+}
+
+// diagnoseAppArchive adds what can be learned from the downloaded app archive
+// to err: whether it's really an HTML page, what it did contain, and the
+// likely causes
+func diagnoseAppArchive(archive string, err error) error {
+	if errors.Is(err, bundle.ErrEmptyArchive) {
+		return err
+	}
+	if looksLikeHTML(archive) {
+		return fmt.Errorf("%w\n  the download is an HTML page, not an archive - usually a login, rate-limit or error page\n"+
+			"  check that the app repo is reachable from here and that any token in use is valid", err)
+	}
+	top := map[string]bool{}
+	bundle.Walk(archive, func(name string, _ int64, _ os.FileMode) {
+		if first, _, _ := strings.Cut(strings.TrimPrefix(name, "./"), "/"); first != "" && first != "pax_global_header" {
+			top[first] = true
+		}
+	})
+	msg := "%w\n  the archive is empty"
+	if len(top) > 0 {
+		msg = "%w\n  top-level entries in the archive: " + strings.Join(slices.Sorted(maps.Keys(top)), ", ")
+	}
+	return fmt.Errorf(msg+"\n  likely causes: the branch or -app-commit doesn't exist, the repo was renamed, "+
+		"or the download was cut short (re-run to retry)", err)
+}
+
+// looksLikeHTML reports whether a downloaded file is actually a web page
+func looksLikeHTML(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	trimmed := bytes.ToLower(bytes.TrimSpace(head[:n]))
+	return bytes.HasPrefix(trimmed, []byte("<!doctype html")) || bytes.HasPrefix(trimmed, []byte("<html"))
+}
+
+// serverLaunchTarget returns the first of the start script (start.sh, or
+// start.bat on Windows) or the server binary that exists in appDir, or "" if
+// neither does
+func serverLaunchTarget(appDir string) string {
+	candidates := []string{"start.sh", "xmlui-test-server"}
+	if runtime.GOOS == "windows" {
+		candidates = []string{"start.bat", "xmlui-test-server.exe"}
+	}
+	for _, name := range candidates {
+		path := filepath.Join(appDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// startBat runs the test server from the app dir, passing its arguments on
+const startBat = `@echo off
+cd /d "%~dp0"
+xmlui-test-server.exe %*
+`
+
+// writeStartBat gives a Windows install the start.bat that the server
+// releases don't ship, since their start.sh can't run there. An existing
+// start.bat is left alone.
+func writeStartBat(appDir string) error {
+	path := filepath.Join(appDir, "start.bat")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(appDir, "xmlui-test-server.exe")); err != nil {
+		return nil
+	}
+	trackCreated(path)
+	return os.WriteFile(path, []byte(startBat), 0755)
+}
+
+// checkAppDir makes sure bundle.MoveIntoPlace produced a real, non-empty app directory
+// before later steps extract the server into it
+func checkAppDir(appDir string) error {
+	info, err := os.Stat(appDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", appDir)
+	}
+	entries, err := os.ReadDir(appDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("app directory %s is empty", appDir)
+	}
+	return nil
+}
+
+// created tracks the install paths this run created so a failed run can roll
+// them back (temporary files are tracked by bundle.AddScratch)
+var created struct {
+	sync.Mutex
+	paths   []string
+	sources map[string]string
+}
+
+// recordSource notes that path, and everything under it unless a deeper
+// path says otherwise, came from url, for the manifest
+func recordSource(path, url string) {
+	created.Lock()
+	defer created.Unlock()
+	if created.sources == nil {
+		created.sources = map[string]string{}
+	}
+	created.sources[filepath.Clean(path)] = url
+}
+
+// sourceOf returns the URL recorded for path or its nearest recorded
+// parent; the caller holds created's lock
+func sourceOf(path string) string {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if url, ok := created.sources[p]; ok {
+			return url
+		}
+		if filepath.Dir(p) == p {
+			return ""
+		}
+	}
+}
+
+// trackCreated records path for rollback if it doesn't exist yet, i.e. if
+// this run is what creates it
+func trackCreated(path string) {
+	if _, err := os.Lstat(path); err == nil {
+		return
+	}
+	created.Lock()
+	defer created.Unlock()
+	created.paths = append(created.paths, path)
+}
+
+// forgetCreated drops what this run tracked or recorded a source for under
+// dir, a staging dir whose contents end up elsewhere
+func forgetCreated(dir string) {
+	created.Lock()
+	defer created.Unlock()
+	under := func(p string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	created.paths = slices.DeleteFunc(created.paths, under)
+	maps.DeleteFunc(created.sources, func(p, _ string) bool { return under(p) })
+}
+
+// rollback removes everything this run created, newest first, so a failed
+// install doesn't leave a half-built tree for the next attempt to trip over
+func rollback() {
+	created.Lock()
+	defer created.Unlock()
+	for i := len(created.paths) - 1; i >= 0; i-- {
+		os.RemoveAll(created.paths[i])
+	}
+	created.paths = nil
+}
+
+// cleanupOnSignal cancels any download in flight on Ctrl-C or SIGTERM, then
+// removes the remaining scratch directories and rolls back what this run
+// created, just as a failed step would, before exiting
+func cleanupOnSignal() {
+	ctx, cancel := context.WithCancel(context.Background())
+	bundle.Context = ctx
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		cancel()
+		if opts.keepOnFailure {
+			fmt.Fprintf(bundle.Output, "\nInterrupted (%v), keeping partial files (-keep-on-failure)\n", sig)
+			os.Exit(130)
+		}
+		fmt.Fprintf(bundle.Output, "\nInterrupted (%v), removing temporary files...\n", sig)
+		bundle.RemoveAllScratch()
+		rollback()
+		os.Exit(130)
+	}()
+}
+
+// configureBundle passes the flags that govern downloading and extraction on
+// to the bundle package
+func configureBundle() {
+	bundle.Timeout = opts.downloadTimeout
+	bundle.PerHost = opts.perHostConcurrency
+	bundle.MaxExtractErrors = opts.maxExtractErrors
+	bundle.Reproducible = opts.reproducible
+	bundle.NoExecBit = opts.noExecBit
+	bundle.Replace = opts.force
+	bundle.CacheDir = cacheDir()
+	bundle.Progress = newExtractReporter()
+	bundle.DownloadProgress = newDownloadReporter
+	bundle.Warnf = warnf
+	switch {
+	case opts.quiet:
+		bundle.Verbosity = bundle.Quiet
+	case opts.verbose:
+		bundle.Verbosity = bundle.Verbose
+	}
+	if opts.json {
+		// Everything written for people (progress, and the reports of
+		// -doctor, -uninstall, -self-update and the like) goes to stderr,
+		// leaving stdout to the JSON records
+		bundle.Output = os.Stderr
+		bundle.Downloaded = func(url string, bytes int64) {
+			emit(progressEvent{Phase: "download", URL: url, Bytes: bytes})
+		}
+	}
+}
+
+func main() {
+	if err := run(); err != nil {
+		os.Exit(exitStatus(err))
+	}
+}
+
+// run does what the flags ask for. Whatever stops it comes back as an error
+// for main to report, so deferred cleanup runs on every path.
+func run() error {
+	parseFlags()
+	if opts.completion != "" {
+		if err := writeCompletion(os.Stdout, opts.completion); err != nil {
+			return usagef("Invalid -completion: %w", err)
+		}
+		return nil
+	}
+	if opts.showVersion {
+		fmt.Println("xmlui-bundler", version)
+		return nil
+	}
+	if err := checkFlags(); err != nil {
+		return err
+	}
+	// A sudo install leaves a root-owned tree the user can't edit later, so
+	// refuse before anything (even the install dir) is created
+	if os.Geteuid() == 0 && !opts.allowRoot {
+		return fail(0, "config", "Refusing to run as root", errors.New("the installed files would be owned by root.\n"+
+			"Run the bundler as your normal user, or pass -allow-root if you really mean it."))
+	}
+	configureBundle()
+	cleanupOnSignal()
+
+	if opts.caFile != "" {
+		if err := trustCAFile(opts.caFile); err != nil {
+			return usagef("Failed to load CA bundle: %w", err)
+		}
+	}
+
+	if opts.trace != "" {
+		traceFile, err := os.Create(opts.trace)
+		if err != nil {
+			return usagef("Failed to open -trace file: %w", err)
+		}
+		defer traceFile.Close()
+		bundle.Client.Transport = &tracingTransport{next: bundle.Client.Transport, w: traceFile}
+	}
+
+	if opts.selfUpdate {
+		if err := selfUpdate(); err != nil {
+			return &exitError{code: 1, err: fmt.Errorf("Self-update failed: %w", err)}
+		}
+		return nil
+	}
+
+	installDir, err := resolveInstallDir()
+	if err != nil {
+		return usagef("Invalid -install-dir: %w", err)
+	}
+
+	if opts.doctor {
+		if !runDoctor(installDir) {
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+
+	if opts.uninstall {
+		if !uninstall(installDir) {
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+
+	if opts.listContents != "" {
+		if err := listArchive(opts.listContents, os.Stdout); err != nil {
+			return &exitError{code: 1, err: fmt.Errorf("Failed to list %s: %w", opts.listContents, err)}
+		}
+		return nil
+	}
+
+	l := newLayout(installDir)
+
+	// Without -interactive (or a terminal to ask on) the defaults stay deterministic
+	if opts.interactive && !opts.dryRun && isTerminal(os.Stdin) {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["mcp-version"] && os.Getenv("XMLUI_MCP_VERSION") == "" && !opts.skipMCP {
+			opts.mcpVersion = pickVersion("MCP tools", "jonudell", "xmlui-mcp", opts.mcpVersion)
+		}
+		if !set["server-version"] && os.Getenv("XMLUI_SERVER_VERSION") == "" && !opts.skipServer {
+			opts.serverVersion = pickVersion("test server", "JonUdell", "xmlui-test-server", opts.serverVersion)
+		}
+	}
+
+	if err := checkSkips(l); err != nil {
+		return usagef("Invalid combination of flags: %w", err)
+	}
+
+	if err := checkPlatform(); err != nil {
+		return usagef("Unsupported platform: %w", err)
+	}
+
+	if opts.printLayout {
+		printLayout(l, os.Stdout)
+		return nil
+	}
+
+	if opts.verifyOnlyDownloads {
+		// The point is to check what the servers hand out now
+		bundle.CacheDir = ""
+		if !verifyDownloads() {
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+
+	if opts.dryRun {
+		dryRun(l, os.Stdout)
+		return nil
+	}
+
+	if recent, age := installedWithin(installDir, opts.since); recent {
+		msg := fmt.Sprintf("Last installed %s ago, within -since %s; nothing to update", age.Round(time.Second), opts.since)
+		if opts.json {
+			emit(progressEvent{Phase: "complete", Dir: installDir, Status: "skipped", Message: msg})
+		} else {
+			bundle.Logf("%s", msg)
+		}
+		return nil
+	}
+
+	trackCreated(installDir)
+	if err := os.MkdirAll(installDir, 0755); err != nil {
+		return fail(0, "filesystem", "Failed to create install directory", err)
+	}
+	if err := checkWritable(installDir); err != nil {
+		return fail(0, "filesystem", "Can't write to "+installDir, err)
+	}
+	// Stage downloads in the install dir rather than /tmp, which is often
+	// RAM-backed on the small machines this matters for
+	bundle.Dir = installDir
+
+	if opts.fromDir == "" {
+		warnClockSkew()
+	}
+
+	if opts.replaceBinariesOnly {
+		if err := runStep(updateBinaries, l); err != nil {
+			return err
+		}
+		writeDigest(installDir)
+		writeManifest(installDir)
+		finish(installDir)
+		return nil
+	}
+
+	if opts.componentsOnly {
+		if err := runStep(updateComponents, l); err != nil {
+			return err
+		}
+		writeDigest(installDir)
+		writeManifest(installDir)
+		finish(installDir)
+		return nil
+	}
+
+	if err := checkExistingInstall(l); err != nil {
+		return err
+	}
+	if err := checkDiskSpace(installDir); err != nil {
+		return fail(0, "filesystem", "Not enough disk space", err)
+	}
+
+	if opts.fromDir != "" {
+		if err := checkLocalArchives(); err != nil {
+			return err
+		}
+	} else if err := prefetch(); err != nil {
+		return err
+	}
+	if err := warningError(); err != nil {
+		return err
+	}
+
+	currentStep = 1
+	if opts.skipApp {
+		bundle.Logf("Skipping XMLUI invoice app (%s)", skippedBy("skip-app"))
+		emit(progressEvent{Phase: "skip"})
+	} else {
+		bundle.Logf("%s", stepHeading(1, "Downloading XMLUI invoice app..."))
+		if err := runStep(installApp, l); err != nil {
+			return err
+		}
+		emit(progressEvent{Phase: "done"})
+	}
+
+	// The server is extracted into the app dir, so remember what the app alone takes
+	var appSize int64
+	if opts.showSize {
+		appSize = dirSize(l.appDir)
+	}
+
+	currentStep = 2
+	if opts.skipComponents {
+		bundle.Logf("Skipping XMLUI components (%s)", skippedBy("skip-components"))
+		emit(progressEvent{Phase: "skip"})
+	} else {
+		bundle.Logf("%s", stepHeading(2, "Downloading XMLUI components..."))
+		if err := runStep(installComponents, l); err != nil {
+			return err
+		}
+		if opts.componentsVerify != "" {
+			if err := verifyComponents(l, opts.componentsVerify); err != nil {
+				return fail(2, "config", "Component set is incomplete", err)
+			}
+			bundle.Logf("✓ Verified component set")
+		}
+		emit(progressEvent{Phase: "done"})
+	}
+
+	currentStep = 3
+	if opts.skipMCP {
+		bundle.Logf("Skipping MCP tools (%s)", skippedBy("skip-mcp"))
+		emit(progressEvent{Phase: "skip"})
+	} else {
+		bundle.Logf("%s", stepHeading(3, "Downloading MCP tools..."))
+		if err := runStep(installMCP, l); err != nil {
+			return err
+		}
+		emit(progressEvent{Phase: "done"})
+	}
+
+	currentStep = 4
+	if opts.skipServer {
+		bundle.Logf("Skipping XMLUI test server (%s)", skippedBy("skip-server"))
+		emit(progressEvent{Phase: "skip"})
+	} else {
+		bundle.Logf("%s", stepHeading(4, "Downloading XMLUI test server..."))
+		if err := runStep(installServer, l); err != nil {
+			return err
+		}
+		emit(progressEvent{Phase: "done"})
+	}
+
+	currentStep = 5
+	bundle.Logf("%s", stepHeading(5, "Organizing the install directory..."))
+	// The final bundle should contain only these files/directories:
+	// - xmlui-invoice/  (the invoice app)
+	// - mcp/  (with docs/ and src/ inside it; at the top level with -output-layout=flat)
+	// - XMLUI_GETTING_STARTED_README.md (unless -no-readme)
+	if !opts.noReadme {
+		trackCreated(filepath.Join(installDir, readmeName))
+		if err := writeReadme(l); err != nil {
+			warnf("Could not write %s: %v", readmeName, err)
+		} else {
+			bundle.Logf("✓ Wrote %s", readmeName)
+		}
+	}
+
+	// Write a cleanup script that will remove files not in the include list
+	if err := writeCleanupScript(installDir, runtime.GOOS); err != nil {
+		warnf("Could not write the cleanup script: %v", err)
+	} else if runtime.GOOS == "windows" {
+		bundle.Logf("Note: Run cleanup.bat to remove the bundler executable and temporary files")
+	} else if opts.noExecBit {
+		bundle.Logf("Note: Run sh cleanup.sh to remove the bundler executable and temporary files")
+	} else {
+		bundle.Logf("Note: Run ./cleanup.sh to remove the bundler executable and temporary files")
+	}
+
+	bundle.Logf("✓ Organized layout complete")
+
+	if opts.showSize {
+		componentsSize := dirSize(l.docsDir) + dirSize(l.srcDir)
+		mcpSize := dirSize(l.mcpDir) - componentsSize
+		if l.mcpDir == l.installDir {
+			// Flat layout: the app sits alongside the tools
+			mcpSize -= dirSize(l.appDir)
+		}
+		serverSize := dirSize(l.appDir) - appSize
+		fmt.Fprintf(bundle.Output, "\nTotal installed size: %s\n", humanSize(appSize+componentsSize+mcpSize+serverSize))
+		fmt.Fprintf(bundle.Output, "  app:        %s\n", humanSize(appSize))
+		fmt.Fprintf(bundle.Output, "  components: %s\n", humanSize(componentsSize))
+		fmt.Fprintf(bundle.Output, "  mcp:        %s\n", humanSize(mcpSize))
+		fmt.Fprintf(bundle.Output, "  server:     %s\n", humanSize(serverSize))
+	}
+
+	if opts.noExecBit && runtime.GOOS != "windows" {
+		bundle.Logf("\nNo execute permissions were set (-no-exec-bit).")
+		if launch := serverLaunchTarget(l.appDir); strings.HasSuffix(launch, ".sh") {
+			bundle.Logf("Start the app with: sh %s", shQuote(launch))
+		}
+		bundle.Logf("The MCP and server binaries must be copied to a volume that allows execution to run.")
+	}
+
+	if opts.summaryJSON {
+		trackCreated(filepath.Join(installDir, "summary.json"))
+		if err := writeSummary(l); err != nil {
+			warnf("Could not write summary.json: %v", err)
+		}
+	}
+	writeDigest(installDir)
+	if err := warningError(); err != nil {
+		return err
+	}
+
+	writeManifest(installDir)
+	finish(installDir)
+	return nil
+}
+
+// manifestName records, in the install dir, what installs there created
+const manifestName = "manifest.json"
+
+// installManifest is the content of manifest.json. Created lists paths
+// relative to the install dir ("." for the dir itself), or absolute ones
+// outside it, oldest first, across every install into the dir. Files lists
+// what is under those paths now, and InstalledAt when that was: the latest
+// install or update.
+type installManifest struct {
+	SchemaVersion int            `json:"schema_version"`
+	InstalledAt   time.Time      `json:"installed_at"`
+	Created       []string       `json:"created"`
+	Files         []manifestFile `json:"files,omitempty"`
+}
+
+// manifestFile is one file or directory an install put in place. URL is
+// the download it came from, empty for files the bundler writes itself.
+type manifestFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Mode string `json:"mode"`
+	URL  string `json:"url,omitempty"`
+}
+
+// readManifest loads the manifest.json in installDir
+func readManifest(installDir string) (*installManifest, error) {
+	data, err := os.ReadFile(filepath.Join(installDir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m installManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestName, err)
+	}
+	return &m, nil
+}
+
+// installedWithin reports whether installDir's manifest records an install
+// less than since ago, and how long ago it was. A since of 0, or a manifest
+// without a time (or none at all), always means an update is due.
+func installedWithin(installDir string, since time.Duration) (bool, time.Duration) {
+	if since <= 0 {
+		return false, 0
+	}
+	m, err := readManifest(installDir)
+	if err != nil || m.InstalledAt.IsZero() {
+		return false, 0
+	}
+	age := time.Since(m.InstalledAt)
+	return age >= 0 && age < since, age
+}
+
+// writeManifest adds the paths this run created to manifest.json, keeping
+// those of earlier installs into the same dir, and lists every file and
+// directory under them with the URL it was downloaded from
+func writeManifest(installDir string) {
+	m, err := readManifest(installDir)
+	if err != nil {
+		m = &installManifest{}
+	}
+	m.SchemaVersion = 1
+	m.InstalledAt = time.Now().UTC().Truncate(time.Second)
+	manifestPath := filepath.Join(installDir, manifestName)
+	trackCreated(manifestPath)
+	rel := func(p string) string {
+		if r, err := filepath.Rel(installDir, p); err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(r)
+		}
+		return p
+	}
+	created.Lock()
+	for _, p := range created.paths {
+		if p = rel(p); !slices.Contains(m.Created, p) {
+			m.Created = append(m.Created, p)
+		}
+	}
+
+	// Files this run didn't download keep the source an earlier run recorded
+	previous := map[string]string{}
+	for _, f := range m.Files {
+		previous[f.Path] = f.URL
+	}
+	m.Files = nil
+	seen := map[string]bool{}
+	for _, p := range m.Created {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(installDir, filepath.FromSlash(p))
+		}
+		filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == manifestPath || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			f := manifestFile{Path: rel(path), Mode: info.Mode().String(), URL: sourceOf(path)}
+			if info.Mode().IsRegular() {
+				f.Size = info.Size()
+			}
+			if f.URL == "" {
+				f.URL = previous[f.Path]
+			}
+			m.Files = append(m.Files, f)
+			return nil
+		})
+	}
+	created.Unlock()
+	data, _ := json.MarshalIndent(m, "", "  ")
+	if err := os.WriteFile(filepath.Join(installDir, manifestName), append(data, '\n'), 0644); err != nil {
+		warnf("Could not write %s: %v", manifestName, err)
+	}
+}
+
+// leftoverPatterns match the scratch files and directories an interrupted
+// run can leave in the install dir
+func leftoverPatterns() []string {
+	return []string{".xmlui-download-*", ".xmlui-write-test-*", ".xmlui-app-*", "xmlui-source", "mcpTmp", "binariesTmp", opts.appRepo + "-*"}
+}
+
+// uninstall removes what installs into installDir created, as recorded in its
+// manifest (or the standard layout's paths with -force when there is none),
+// plus any leftover scratch files, once confirmed. It reports whether it
+// succeeded.
+func uninstall(installDir string) bool {
+	w := bundle.Output
+	var targets []string
+	m, err := readManifest(installDir)
+	switch {
+	case err == nil:
+		for _, p := range m.Created {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(installDir, filepath.FromSlash(p))
+			}
+			targets = append(targets, p)
+		}
+	case opts.force:
+		l := newLayout(installDir)
+		targets = []string{l.appDir}
+		if l.mcpDir != installDir {
+			targets = append(targets, l.mcpDir)
+		} else {
+			for _, name := range mcpFiles() {
+				targets = append(targets, filepath.Join(installDir, name))
+			}
+			targets = append(targets, l.docsDir, l.srcDir)
+		}
+		for _, name := range []string{readmeName, "cleanup.sh", "cleanup.bat", "summary.json", digestName} {
+			targets = append(targets, filepath.Join(installDir, name))
+		}
+	default:
+		fmt.Fprintf(w, "Can't uninstall from %s: %v\n", installDir, err)
+		fmt.Fprintln(w, "Pass -force to remove the standard layout's paths instead of those listed in a manifest.")
+		return false
+	}
+	for _, pattern := range leftoverPatterns() {
+		matches, _ := filepath.Glob(filepath.Join(installDir, pattern))
+		targets = append(targets, matches...)
+	}
+
+	// The install dir itself goes last, and only if nothing else is left in it
+	removeDir := false
+	var existing []string
+	for _, p := range targets {
+		if p == installDir {
+			removeDir = true
+			continue
+		}
+		if _, err := os.Lstat(p); err == nil && !slices.Contains(existing, p) {
+			existing = append(existing, p)
+		}
+	}
+	if len(existing) == 0 {
+		fmt.Fprintf(w, "Nothing to uninstall in %s\n", installDir)
+		return true
+	}
+	fmt.Fprintln(w, "This will delete:")
+	for _, p := range existing {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if !opts.yes && !opts.force {
+		if opts.json || !isTerminal(os.Stdin) {
+			fmt.Fprintln(w, "Re-run with -yes to delete them.")
+			return false
+		}
+		fmt.Fprint(w, "Delete these? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Fprintln(w, "Nothing deleted.")
+			return false
+		}
+	}
+
+	ok := true
+	for i := len(existing) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(existing[i]); err != nil {
+			fmt.Fprintf(w, "Could not delete %s: %v\n", existing[i], err)
+			ok = false
+		}
+	}
+	if removeDir {
+		os.Remove(installDir)
+	}
+	if ok {
+		fmt.Fprintf(w, "✓ Uninstalled from %s\n", installDir)
+	}
+	return ok
+}
+
+// readmeName is the getting-started guide written into the install dir
+const readmeName = "XMLUI_GETTING_STARTED_README.md"
+
+// defaultReadme is the built-in template for readmeName
+const defaultReadme = `# Getting started with XMLUI
+
+This bundle was installed into {{.InstallDir}}.
+
+## Run the invoice app
+
+{{if .Launch}}Start the XMLUI test server ({{.ServerVersion}}) and open the address it prints:
+
+    {{.Launch}}
+{{else}}The test server wasn't installed, so serve {{.AppDir}} with any static web server.
+{{end}}{{if .MCPVersion}}
+## Use the MCP tools
+
+The MCP server ({{.MCPVersion}}) is in {{.MCPDir}}, with the component docs and
+source it searches in docs/ and src/ next to it. Point your MCP client at the
+xmlui-mcp binary there.
+{{end}}`
+
+// readmeData is what a readme template can refer to
+type readmeData struct {
+	InstallDir    string
+	AppDir        string
+	MCPDir        string
+	MCPVersion    string
+	ServerVersion string
+	Launch        string
+}
+
+// loadReadmeTemplate parses -readme-template, or the built-in template if it's unset
+func loadReadmeTemplate() (*template.Template, error) {
+	text := defaultReadme
+	if opts.readmeTemplate != "" {
+		data, err := os.ReadFile(opts.readmeTemplate)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New(readmeName).Option("missingkey=error").Parse(text)
+}
+
+// writeReadme renders the getting-started guide into the install dir
+func writeReadme(l *layout) error {
+	tmpl, err := loadReadmeTemplate()
+	if err != nil {
+		return err
+	}
+	data := readmeData{
+		InstallDir:    l.installDir,
+		AppDir:        l.appDir,
+		MCPDir:        l.mcpDir,
+		ServerVersion: opts.serverVersion,
+	}
+	if !opts.skipMCP {
+		data.MCPVersion = opts.mcpVersion
+	}
+	if launch := serverLaunchTarget(l.appDir); launch != "" {
+		data.Launch = shQuote(launch)
+		if runtime.GOOS == "windows" {
+			data.Launch = batQuote(launch)
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.installDir, readmeName), buf.Bytes(), 0644)
+}
+
+// summarySchemaVersion is bumped whenever a summary.json field changes meaning
+// or goes away; adding fields doesn't bump it
+const summarySchemaVersion = 1
+
+// installSummary is the content of summary.json: a short, stable description
+// of an install for dashboards and support tooling
+type installSummary struct {
+	SchemaVersion int               `json:"schema_version"`
+	InstalledAt   time.Time         `json:"installed_at"`
+	Platform      string            `json:"platform"`
+	Layout        string            `json:"layout"`
+	Versions      map[string]string `json:"versions"`
+	Assets        map[string]string `json:"assets"`
+	TotalSize     int64             `json:"total_size"`
+}
+
+// writeSummary writes summary.json for the steps that ran into the install dir
+func writeSummary(l *layout) error {
+	summary := installSummary{
+		SchemaVersion: summarySchemaVersion,
+		InstalledAt:   time.Now().UTC().Truncate(time.Second),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		Layout:        opts.outputLayout,
+		Versions:      map[string]string{},
+		Assets:        map[string]string{},
+	}
+	if !opts.skipApp {
+		summary.Versions["app"] = opts.appBranch
+		if opts.appCommit != "" {
+			summary.Versions["app"] = opts.appCommit
+		}
+		summary.Assets["app"] = appArchiveURL()
+	}
+	if !opts.skipComponents {
+		summary.Versions["components"] = opts.componentsRef
+		summary.Assets["components"] = xmluiArchiveURL()
+	}
+	if !opts.skipMCP {
+		summary.Versions["mcp"] = opts.mcpVersion
+		summary.Assets["mcp"] = getPlatformSpecificMCPURL(opts.mcpVersion)
+	}
+	if !opts.skipServer {
+		summary.Versions["server"] = opts.serverVersion
+		summary.Assets["server"] = getPlatformSpecificServerURL(opts.serverVersion)
+	}
+	if l.mcpDir == l.installDir {
+		summary.TotalSize = dirSize(l.installDir)
+	} else {
+		summary.TotalSize = dirSize(l.appDir) + dirSize(l.mcpDir)
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.installDir, "summary.json"), append(data, '\n'), 0644)
+}
+
+// digestName is the file -emit-digest writes into the install dir
+const digestName = "bundle.sha256"
+
+// writeDigest writes digestName when -emit-digest is set: the SHA-256 of
+// every file in the install dir by sorted slash path, in sha256sum format so
+// "sha256sum -c" can check it from there, then a last comment line with the
+// SHA-256 of those lines. Digests cover content only, so two installs of the
+// same assets on the same platform match however long ago each ran. The
+// files the bundler writes about the install itself (the guide, which names
+// the install dir, summary.json, the manifest and the cleanup scripts) are
+// left out, as is the bundler when it sits in the install dir.
+func writeDigest(installDir string) {
+	if !opts.emitDigest {
+		return
+	}
+	skip := map[string]bool{}
+	for _, name := range []string{readmeName, "summary.json", manifestName, digestName, "cleanup.sh", "cleanup.bat"} {
+		skip[filepath.Join(installDir, name)] = true
+	}
+	if exe, err := executable(); err == nil {
+		skip[exe] = true
+	}
+
+	sums := map[string]string{}
+	err := filepath.WalkDir(installDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || skip[path] {
+			return err
+		}
+		// Links are followed, as sha256sum does
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(installDir, path)
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		warnf("Could not write %s: %v", digestName, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, name := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[name], name)
+	}
+	total := sha256.Sum256(buf.Bytes())
+	fmt.Fprintf(&buf, "# bundle %x\n", total)
+
+	path := filepath.Join(installDir, digestName)
+	trackCreated(path)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		warnf("Could not write %s: %v", digestName, err)
+		return
+	}
+	bundle.Logf("✓ Wrote %s (%d files, bundle digest %x)", digestName, len(sums), total)
+}
+
+// writeCleanupScript writes cleanup.sh, or cleanup.bat when goos is
+// windows, into installDir. The script removes the bundler executable, any
+// archives left in the dir and every scratch path an install can leave
+// behind, then itself. Whatever the manifest or this run recorded as
+// installed is spared even when a pattern matches it, so the script can
+// never remove part of the install.
+func writeCleanupScript(installDir, goos string) error {
+	var installed []string
+	if m, err := readManifest(installDir); err == nil {
+		installed = m.Created
+	}
+	created.Lock()
+	for _, p := range created.paths {
+		if r, err := filepath.Rel(installDir, p); err == nil {
+			installed = append(installed, filepath.ToSlash(r))
+		}
+	}
+	created.Unlock()
+	patterns := append([]string{"*.zip", "*.tar.gz"}, leftoverPatterns()...)
+	var keep []string
+	for _, p := range installed {
+		if slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, _ := path.Match(pattern, p)
+			return ok
+		}) {
+			keep = append(keep, p)
+		}
+	}
+	// Only the bundler's own copy goes, never a file that merely shares its
+	// name in an -install-dir it wasn't run from
+	self := bundlerInDir(installDir)
+
+	var script strings.Builder
+	name := "cleanup.sh"
+	if goos == "windows" {
+		name = "cleanup.bat"
+		line := func(format string, args ...any) { fmt.Fprintf(&script, format+"\r\n", args...) }
+		line("@echo off")
+		// Read non-ASCII file names as UTF-8 rather than the OEM code page
+		line("chcp 65001 >nul")
+		line(`cd /d "%%~dp0"`)
+		line("echo Cleaning up temporary files...")
+		if self != "" {
+			self = strings.ReplaceAll(self, "/", `\`)
+			line("if exist %s del %s", batQuote(self), batQuote(self))
+		}
+		// for runs its command for each match, skipping those in keep
+		spare := func(v, pattern string) string {
+			var conds strings.Builder
+			for _, p := range keep {
+				if ok, _ := path.Match(pattern, p); ok {
+					fmt.Fprintf(&conds, `if /i not "%%%%~nx%s"==%s `, v, batQuote(p))
+				}
+			}
+			return conds.String()
+		}
+		for _, pattern := range patterns {
+			line(`for /d %%%%d in (%s) do %srmdir /s /q "%%%%d"`, batQuote(pattern), spare("d", pattern))
+			line(`for %%%%f in (%s) do %sdel /q "%%%%f"`, batQuote(pattern), spare("f", pattern))
+		}
+		// cmd.exe reads batch files as it runs them, so delete ourselves on
+		// the last line in a way that doesn't need to read anything further
+		line(`(goto) 2>nul & del "%%~f0"`)
+	} else {
+		line := func(format string, args ...any) { fmt.Fprintf(&script, format+"\n", args...) }
+		line("#!/bin/sh")
+		line(`cd "$(dirname "$0")" || exit 1`)
+		line("echo Cleaning up temporary files...")
+		if self != "" {
+			line("rm -f %s", shQuote(self))
+		}
+		// The patterns are left unquoted to expand; none has a space in it.
+		// One that matches nothing stays as it is, which rm -f ignores.
+		line("for f in %s; do", strings.Join(patterns, " "))
+		if len(keep) > 0 {
+			quoted := make([]string, len(keep))
+			for i, p := range keep {
+				quoted[i] = shQuote(p)
+			}
+			line(`	case "$f" in %s) continue ;; esac`, strings.Join(quoted, " | "))
+		}
+		line(`	rm -rf -- "$f"`)
+		line("done")
+		// exec replaces the shell, so nothing is read from the script after it's gone
+		line(`exec rm -f "$(basename "$0")"`)
+	}
+
+	scriptPath := filepath.Join(installDir, name)
+	trackCreated(scriptPath)
+	if err := os.WriteFile(scriptPath, []byte(script.String()), 0644); err != nil {
+		return err
+	}
+	if goos != "windows" {
+		bundle.EnsureExecutable(scriptPath)
+	}
+	return nil
+}
+
+// executable finds the running bundler; tests replace it
+var executable = os.Executable
+
+// bundlerInDir returns the running bundler's path relative to dir, slash
+// separated, or "" when it isn't inside dir
+func bundlerInDir(dir string) string {
+	exe, err := executable()
+	if err != nil {
+		return ""
+	}
+	if real, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = real
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	rel, err := filepath.Rel(dir, exe)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// shQuote quotes s for a POSIX shell so spaces, quotes and $ in a path are
+// taken literally
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// batQuote quotes s for a cmd.exe batch file, doubling % so it isn't read as
+// a variable (Windows file names can't contain double quotes)
+func batQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, "%", "%%") + `"`
+}
+
+// layout holds the directories the install steps work in
+type layout struct {
+	installDir string
+	appDir     string
+	mcpDir     string
+	docsDir    string
+	srcDir     string
+}
+
+// newLayout returns the directories for the chosen -output-layout:
+//
+//	nested: xmlui-invoice/, mcp/ (tools), mcp/docs/, mcp/src/
+//	flat:   xmlui-invoice/, plus the tools, docs/ and src/ at the top level
+func newLayout(installDir string) *layout {
+	mcpDir := filepath.Join(installDir, "mcp")
+	if opts.outputLayout == "flat" {
+		mcpDir = installDir
+	}
+	return &layout{
+		installDir: installDir,
+		appDir:     filepath.Join(installDir, opts.appRepo),
+		mcpDir:     mcpDir,
+		docsDir:    filepath.Join(mcpDir, "docs"),
+		srcDir:     filepath.Join(mcpDir, "src"),
+	}
+}
+
+// printLayout describes the directory tree an install with the current flags
+// would produce, without downloading anything
+func printLayout(l *layout, w io.Writer) {
+	rel := func(path string) string {
+		if r, err := filepath.Rel(l.installDir, path); err == nil {
+			return filepath.ToSlash(r) + "/"
+		}
+		return path
+	}
+	row := func(path, what string) {
+		fmt.Fprintf(w, "  %-34s %s\n", path, what)
+	}
+
+	fmt.Fprintf(w, "Planned layout in %s (%s):\n", l.installDir, opts.outputLayout)
+	if !opts.skipApp {
+		row(rel(l.appDir), "invoice app from "+appArchiveURL())
+	}
+	if !opts.skipServer {
+		row(rel(l.appDir), "test server "+opts.serverVersion+" from "+path.Base(getPlatformSpecificServerURL(opts.serverVersion)))
+	}
+	if !opts.skipMCP {
+		row(rel(l.mcpDir), "MCP tools "+opts.mcpVersion+" from "+path.Base(getPlatformSpecificMCPURL(opts.mcpVersion)))
+		if opts.linkBin != "" {
+			row(opts.linkBin, "links to the MCP binaries")
+		}
+	}
+	if !opts.skipComponents {
+		row(rel(filepath.Join(l.docsDir, "pages", "components")), "component docs from xmlui@"+opts.componentsRef)
+		row(rel(filepath.Join(l.srcDir, "components")), "component source from xmlui@"+opts.componentsRef)
+		if intoDir, err := componentsIntoDir(l); err == nil && intoDir != "" {
+			row(rel(intoDir), "copy of the component source")
+		}
+	}
+	script := "cleanup.sh"
+	if runtime.GOOS == "windows" {
+		script = "cleanup.bat"
+	}
+	row(script, "removes the bundler and leftover archives")
+}
+
+// dryRun prints, step by step, what an install with the current flags would
+// download, where it would extract, and what it would move, without any
+// network requests or writes
+func dryRun(l *layout, w io.Writer) {
+	say := func(format string, args ...any) {
+		fmt.Fprintf(w, "  "+format+"\n", args...)
+	}
+	fmt.Fprintln(w, "Dry run: nothing will be downloaded or written")
+	if n := len(plannedAssets()); opts.fromDir == "" && opts.parallel > 1 && n > 1 {
+		fmt.Fprintf(w, "The %d downloads run first, up to %d at a time (-parallel)\n", n, opts.parallel)
+	}
+
+	if opts.skipApp {
+		fmt.Fprintf(w, "Skipping XMLUI invoice app (%s)\n", skippedBy("skip-app"))
+	} else {
+		fmt.Fprintln(w, stepHeading(1, "Downloading XMLUI invoice app..."))
+		say("%s", fetchPlan(1, appArchiveURL()))
+		if opts.appArchiveFormat == "tar.gz" && opts.appSubdir == "" {
+			say("extract into %s, dropping the archive's top-level folder", l.appDir)
+		} else {
+			extracted := filepath.Join(l.installDir, opts.appRepo+"-*")
+			say("extract into %s", l.installDir)
+			say("move %s to %s", filepath.Join(extracted, filepath.FromSlash(opts.appSubdir)), l.appDir)
+			if opts.appSubdir != "" {
+				say("remove the rest of %s", extracted)
+			}
+		}
+	}
+
+	if opts.skipComponents {
+		fmt.Fprintf(w, "Skipping XMLUI components (%s)\n", skippedBy("skip-components"))
+	} else {
+		fmt.Fprintln(w, stepHeading(2, "Downloading XMLUI components..."))
+		tmpDir := filepath.Join(l.installDir, "xmlui-source")
+		sourceRoot := filepath.Join(tmpDir, "xmlui-*")
+		verb := "copy"
+		if opts.componentsOnlyChanged {
+			verb = "sync changed files from"
+		}
+		say("%s", fetchPlan(2, xmluiArchiveURL()))
+		say("extract into %s", tmpDir)
+		say("%s %s to %s", verb, filepath.Join(sourceRoot, "docs", "pages", "components"), filepath.Join(l.docsDir, "pages", "components"))
+		say("%s %s to %s", verb, filepath.Join(sourceRoot, filepath.FromSlash(opts.componentsStripPrefix), "src", "components"),
+			filepath.Join(l.srcDir, "components"))
+		say("prune %s from the component source", strings.Join(append(append([]string{}, defaultPrune...), opts.prune...), ", "))
+		if intoDir, err := componentsIntoDir(l); err == nil && intoDir != "" {
+			say("copy %s to %s", filepath.Join(l.srcDir, "components"), intoDir)
+		}
+		say("remove %s", tmpDir)
+	}
+
+	if opts.skipMCP {
+		fmt.Fprintf(w, "Skipping MCP tools (%s)\n", skippedBy("skip-mcp"))
+	} else {
+		fmt.Fprintln(w, stepHeading(3, "Downloading MCP tools..."))
+		tmpMCP := filepath.Join(l.installDir, "mcpTmp")
+		say("%s", fetchPlan(3, getPlatformSpecificMCPURL(opts.mcpVersion)))
+		say("extract into %s", tmpMCP)
+		for _, name := range mcpFiles() {
+			say("move %s to %s", filepath.Join(tmpMCP, name), filepath.Join(l.mcpDir, name))
+		}
+		say("remove %s", tmpMCP)
+		if l.mcpDir != l.installDir {
+			say("merge %s and %s, if present, into %s and %s", filepath.Join(l.installDir, "docs"), filepath.Join(l.installDir, "src"),
+				l.docsDir, l.srcDir)
+		}
+		if opts.linkBin != "" {
+			say("link the MCP binaries into %s", opts.linkBin)
+		}
+	}
+
+	if opts.skipServer {
+		fmt.Fprintf(w, "Skipping XMLUI test server (%s)\n", skippedBy("skip-server"))
+	} else {
+		fmt.Fprintln(w, stepHeading(4, "Downloading XMLUI test server..."))
+		say("%s", fetchPlan(4, getPlatformSpecificServerURL(opts.serverVersion)))
+		say("extract into %s", l.appDir)
+		if runtime.GOOS == "windows" {
+			say("write %s", filepath.Join(l.appDir, "start.bat"))
+		}
+	}
+
+	fmt.Fprintln(w, stepHeading(5, "Organizing the install directory..."))
+	script := "cleanup.sh"
+	if runtime.GOOS == "windows" {
+		script = "cleanup.bat"
+	}
+	if !opts.noReadme {
+		say("write %s", filepath.Join(l.installDir, readmeName))
+	}
+	say("write %s", filepath.Join(l.installDir, script))
+	if opts.summaryJSON {
+		say("write %s", filepath.Join(l.installDir, "summary.json"))
+	}
+	if opts.emitDigest {
+		say("write %s", filepath.Join(l.installDir, digestName))
+	}
+	say("write %s", filepath.Join(l.installDir, manifestName))
+}
+
+// asset is an archive an install downloads
+type asset struct {
+	what    string
+	url     string
+	release bool   // a GitHub release asset, which may have a published checksum
+	approx  int64  // rough size, for when the server doesn't say
+	local   string // the file name -from-dir looks for
+}
+
+// plannedAssets returns the archives the flags would download, in install order
+func plannedAssets() []asset {
+	all := []struct {
+		asset
+		skip bool
+	}{
+		{asset{"XMLUI invoice app", appArchiveURL(), false, 5 << 20, localArchiveName(1)}, opts.skipApp},
+		{asset{"XMLUI repo", xmluiArchiveURL(), false, 150 << 20, localArchiveName(2)}, opts.skipComponents},
+		{asset{"MCP tools", getPlatformSpecificMCPURL(opts.mcpVersion), true, 20 << 20, localArchiveName(3)}, opts.skipMCP},
+		{asset{"test server", getPlatformSpecificServerURL(opts.serverVersion), true, 20 << 20, localArchiveName(4)}, opts.skipServer},
+	}
+	var assets []asset
+	for _, a := range all {
+		if !a.skip {
+			assets = append(assets, a.asset)
+		}
+	}
+	return assets
+}
+
+// verifyDownloads fetches each asset the flags would install and checks it
+// against its published checksum, keeping nothing. It reports whether they
+// all passed.
+func verifyDownloads() bool {
+	w := bundle.Output
+	ok := true
+	var results []string
+	for _, a := range plannedAssets() {
+		archive, err := bundle.DownloadWithRetry(a.url, a.what, downloadAttempts)
+		if err != nil {
+			ok = false
+			results = append(results, fmt.Sprintf("[FAIL] %s: %v", a.what, err))
+			continue
+		}
+		var size int64
+		if info, err := os.Stat(archive); err == nil {
+			size = info.Size()
+		}
+		status := "downloaded" // codeload archives are generated on demand and have no checksum
+		if a.release {
+			var expected string
+			if expected, err = publishedChecksum(a.url); err == nil {
+				status = "no checksum published"
+				if expected != "" {
+					status = "sha256 matches"
+					err = bundle.VerifyChecksum(archive, expected)
+				}
+			}
+		}
+		bundle.RemoveScratch(archive)
+		if err != nil {
+			ok = false
+			results = append(results, fmt.Sprintf("[FAIL] %s: %v", a.what, err))
+			continue
+		}
+		results = append(results, fmt.Sprintf("[PASS] %s (%s, %s)", a.what, humanSize(size), status))
+	}
+	fmt.Fprintln(w)
+	for _, r := range results {
+		fmt.Fprintln(w, r)
+	}
+	return ok
+}
+
+// checkSkips rejects -skip-* combinations that leave a later step, or another
+// flag, with nothing to work on
+func checkSkips(l *layout) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var conflicts []string
+	requires := func(skipped bool, skipFlag string, dependents ...string) {
+		if !skipped {
+			return
+		}
+		for _, name := range dependents {
+			if set[name] {
+				conflicts = append(conflicts, fmt.Sprintf("-%s has no effect with %s", name, skippedBy(skipFlag)))
+			}
+		}
+	}
+	requires(opts.skipApp, "skip-app", "app-subdir", "app-commit", "app-archive-format")
+	requires(opts.skipComponents, "skip-components",
+		"components-only-changed", "components-format", "components-strip-prefix", "components-ref", "components-verify", "components-into", "prune")
+	requires(opts.skipMCP, "skip-mcp", "mcp-version", "link-bin")
+	requires(opts.skipServer, "skip-server", "server-version")
+
+	// The server is extracted into the app, and -components-into copies into
+	// it, so without step 1 they need one already installed
+	if opts.skipApp {
+		fix := "use -skip-server with -skip-app"
+		if opts.only != "" {
+			fix = "add app to -only"
+		}
+		_, err := os.Stat(l.appDir)
+		if !opts.skipServer && err != nil {
+			conflicts = append(conflicts,
+				fmt.Sprintf("installing the server needs the app: %s, or install the app into %s first", fix, l.appDir))
+		}
+		if !opts.skipComponents && opts.componentsInto != "" && err != nil {
+			conflicts = append(conflicts,
+				fmt.Sprintf("-components-into needs the app: install it into %s first", l.appDir))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return errors.New(strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// fetchApp downloads the invoice app archive (step 1). codeload builds the
+// archive on the fly, so there's no published checksum to verify; a
+// truncated zip is still caught when it's opened.
+func fetchApp() (string, error) {
+	appZip, err := bundle.DownloadWithRetry(appArchiveURL(), "XMLUI invoice app", downloadAttempts)
+	if err != nil {
+		return "", fail(1, "network", "Failed to download app", err)
+	}
+	return appZip, nil
+}
+
+// fetchComponents downloads the xmlui repo archive the components come from (step 2)
+func fetchComponents() (string, error) {
+	xmluiZip, err := bundle.DownloadWithRetry(xmluiArchiveURL(), "XMLUI repo", downloadAttempts)
+	if err != nil {
+		return "", fail(2, "network", "Failed to download XMLUI source", err)
+	}
+	return xmluiZip, nil
+}
+
+// fetchMCP downloads the MCP tools release asset for this platform (step 3)
+func fetchMCP() (string, error) {
+	mcpUrl := getPlatformSpecificMCPURL(opts.mcpVersion)
+	override := ""
+	if opts.mcpVersion != defaultMCPVersion {
+		override = "-mcp-version " + opts.mcpVersion
+	}
+	explainAssetChoice("MCP tools", mcpUrl, override)
+	if opts.mcpVersion != defaultMCPVersion || platformAssets[runtime.GOOS+"/"+runtime.GOARCH].partial {
+		if err := assetExists(mcpUrl); err != nil {
+			return "", fail(3, "config", fmt.Sprintf("MCP tools %s are not available for %s/%s", opts.mcpVersion, runtime.GOOS, runtime.GOARCH), err)
+		}
+	}
+	mcpArchive, err := downloadAsset(mcpUrl, "MCP tools")
+	if err != nil {
+		return "", fail(3, "network", "Failed to download MCP tools", err)
+	}
+	return mcpArchive, nil
+}
+
+// fetchServer downloads the test server release asset for this platform (step 4)
+func fetchServer() (string, error) {
+	serverURL := getPlatformSpecificServerURL(opts.serverVersion)
+	override := ""
+	if opts.serverVersion != defaultServerVersion {
+		override = "-server-version " + opts.serverVersion
+	}
+	explainAssetChoice("test server", serverURL, override)
+	if opts.serverVersion != defaultServerVersion || platformAssets[runtime.GOOS+"/"+runtime.GOARCH].partial {
+		if err := assetExists(serverURL); err != nil {
+			return "", fail(4, "config", fmt.Sprintf("Test server %s is not available for %s/%s", opts.serverVersion, runtime.GOOS, runtime.GOARCH), err)
+		}
+	}
+	serverArchive, err := downloadAsset(serverURL, "test server")
+	if err != nil {
+		return "", fail(4, "network", "Failed to download server", err)
+	}
+	return serverArchive, nil
+}
+
+// fetchers download each install step's archive, by step
+var fetchers = map[int]func() (string, error){1: fetchApp, 2: fetchComponents, 3: fetchMCP, 4: fetchServer}
+
+// prefetched holds the archives prefetch downloaded, by step, until the
+// step takes its own
+var prefetched = map[int]string{}
+
+// download returns the archive for step: a copy of the -from-dir one, the
+// one prefetch got, or a fresh download when downloads aren't run ahead
+func download(step int) (string, error) {
+	if opts.fromDir != "" {
+		return localArchive(step)
+	}
+	if archive, ok := prefetched[step]; ok {
+		delete(prefetched, step)
+		return archive, nil
+	}
+	return fetchers[step]()
+}
+
+// localArchiveName is the file -from-dir expects for step's archive: what
+// GitHub's Download ZIP button names a repo archive (<repo>-<ref>.zip), and
+// the release asset's own name for the MCP tools and test server
+func localArchiveName(step int) string {
+	switch step {
+	case 1:
+		ref, ext := opts.appBranch, ".zip"
+		if opts.appCommit != "" {
+			ref = opts.appCommit
+		}
+		if opts.appArchiveFormat == "tar.gz" {
+			ext = ".tar.gz"
+		}
+		return opts.appRepo + "-" + refName(ref) + ext
+	case 2:
+		ext := ".zip"
+		if opts.componentsFormat == "tar.gz" {
+			ext = ".tar.gz"
+		}
+		return "xmlui-" + refName(opts.componentsRef) + ext
+	case 3:
+		return path.Base(getPlatformSpecificMCPURL(opts.mcpVersion))
+	default:
+		return path.Base(getPlatformSpecificServerURL(opts.serverVersion))
+	}
+}
+
+// refName is how a git ref appears in a downloaded archive's name: without
+// refs/heads/ or refs/tags/, and with any other slashes as dashes
+func refName(ref string) string {
+	ref = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	return strings.ReplaceAll(ref, "/", "-")
+}
+
+// fetchPlan says, for -dry-run, where step's archive will come from
+func fetchPlan(step int, url string) string {
+	if opts.fromDir != "" {
+		return "use " + filepath.Join(opts.fromDir, localArchiveName(step))
+	}
+	return "download " + url
+}
+
+// checkLocalArchives makes sure -from-dir holds the archive of every step
+// that will run before any is installed
+func checkLocalArchives() error {
+	for step := 1; step <= 4; step++ {
+		if stepSkipped(step) {
+			continue
+		}
+		name := localArchiveName(step)
+		if _, err := os.Stat(filepath.Join(opts.fromDir, name)); err != nil {
+			return fail(step, "config", "Missing archive in -from-dir", fmt.Errorf("expected %s in %s", name, opts.fromDir))
+		}
+	}
+	return nil
+}
+
+// localArchive stages a copy of step's archive from -from-dir as scratch,
+// as a download would be, since the steps remove their archive when done.
+// A hard link saves copying when both dirs are on one volume.
+func localArchive(step int) (string, error) {
+	name := localArchiveName(step)
+	src := filepath.Join(opts.fromDir, name)
+	bundle.Logf("Using %s", src)
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fail(step, "config", "Missing archive in -from-dir", fmt.Errorf("expected %s in %s", name, opts.fromDir))
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(bundle.Dir, ".xmlui-download-*")
+	if err != nil {
+		return "", fail(step, "filesystem", "Failed to stage "+name, err)
+	}
+	staged := out.Name()
+	bundle.AddScratch(staged)
+	out.Close()
+	os.Remove(staged)
+	if os.Link(src, staged) == nil {
+		return staged, nil
+	}
+	if out, err = os.Create(staged); err == nil {
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		bundle.RemoveScratch(staged)
+		return "", fail(step, "filesystem", "Failed to stage "+name, err)
+	}
+	return staged, nil
+}
+
+// prefetching is set while prefetch runs downloads side by side, so their
+// progress lines say which download they're about
+var prefetching bool
+
+// prefetch downloads the archives of the steps that will run, up to
+// -parallel at a time, so the install waits on the slowest download rather
+// than the sum of them. The steps then extract them in their usual order.
+// The first failure cancels the other downloads and is returned as the
+// failure of its step. Output lines from the downloads are kept whole but
+// may interleave.
+func prefetch() error {
+	var steps []int
+	for step := 1; step <= 4; step++ {
+		if !stepSkipped(step) {
+			steps = append(steps, step)
+		}
+	}
+	if opts.parallel < 2 || len(steps) < 2 {
+		return nil
+	}
+	bundle.Logf("Downloading %d archives, up to %d at a time...", len(steps), opts.parallel)
+
+	parent, output := bundle.Context, bundle.Output
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	bundle.Context, bundle.Output, prefetching = ctx, &lockedWriter{w: output}, true
+	defer func() { bundle.Context, bundle.Output, prefetching = parent, output, false }()
+
+	archives := make([]string, len(steps))
+	errs := make([]error, len(steps))
+	slots := make(chan struct{}, opts.parallel)
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if ctx.Err() != nil {
+				errs[i] = ctx.Err()
+				return
+			}
+			if archives[i], errs[i] = fetchers[step](); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Report the failure that canceled the rest, not the cancellations
+	var failed error
+	for _, err := range errs {
+		if err != nil && (failed == nil || errors.Is(failed, context.Canceled)) {
+			failed = err
+		}
+	}
+	for i, step := range steps {
+		switch {
+		case archives[i] == "":
+		case failed != nil:
+			bundle.RemoveScratch(archives[i])
+		default:
+			prefetched[step] = archives[i]
+		}
+	}
+	return failed
+}
+
+// lockedWriter serializes writes to w, so lines printed from concurrent
+// downloads come out whole
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// installApp downloads the invoice app and moves it to l.appDir (step 1)
+func installApp(l *layout) error {
+	appZip, err := download(1)
+	if err != nil {
+		return err
+	}
+	defer bundle.RemoveScratch(appZip)
+
+	format := opts.appArchiveFormat
+	if format == "auto" {
+		format = bundle.DetectFormat(appZip)
+	}
+	trackCreated(l.appDir)
+	srcParent := l.installDir
+	if format == "tar.gz" && opts.appSubdir == "" {
+		// Strip the xmlui-invoice-<ref>/ folder into a scratch dir, then move
+		// it into place like the zip, so an existing app dir is refused or
+		// replaced (-force) rather than merged into
+		staging, err := os.MkdirTemp(l.installDir, ".xmlui-app-")
+		if err != nil {
+			return fail(1, "filesystem", "Failed to extract app", err)
+		}
+		bundle.AddScratch(staging)
+		defer bundle.RemoveScratch(staging)
+		if err := bundle.UntarGzStrip(appZip, filepath.Join(staging, opts.appRepo+"-app"), 1); err != nil {
+			return fail(1, "extract", "Failed to extract app", diagnoseAppArchive(appZip, err))
+		}
+		srcParent = staging
+	} else {
+		before, _ := filepath.Glob(filepath.Join(l.installDir, opts.appRepo+"-*"))
+		err = bundle.Extract(appZip, l.installDir, format)
+		// Whatever the archive unpacked next to the app dir is scratch until moved
+		after, _ := filepath.Glob(filepath.Join(l.installDir, opts.appRepo+"-*"))
+		for _, path := range after {
+			if !slices.Contains(before, path) {
+				bundle.AddScratch(path)
+			}
+		}
+		if err != nil {
+			return fail(1, "extract", "Failed to extract app", diagnoseAppArchive(appZip, err))
+		}
+	}
+
+	appDir, err := bundle.MoveIntoPlace(srcParent, opts.appRepo, l.installDir, opts.appSubdir)
+	if errors.Is(err, bundle.ErrRepoDirNotFound) {
+		return fail(1, "extract", "Failed to organize app directory", diagnoseAppArchive(appZip, err))
+	}
+	if errors.Is(err, bundle.ErrDestinationExists) {
+		return fail(1, "filesystem", "Failed to organize app directory",
+			fmt.Errorf("%w; remove it, or pass -force to replace it", err))
+	}
+	if err != nil {
+		return fail(1, "filesystem", "Failed to organize app directory", err)
+	}
+	if err := checkAppDir(appDir); err != nil {
+		return fail(1, "extract", "App download looks wrong", err)
+	}
+	l.appDir = appDir
+	recordSource(l.appDir, appArchiveURL())
+	return nil
+}
+
+// installComponents copies the XMLUI component docs and source out of the
+// xmlui repo into mcp/docs and mcp/src (step 2)
+func installComponents(l *layout) error {
+	intoDir, err := componentsIntoDir(l)
+	if err != nil {
+		return fail(2, "config", "Invalid -components-into", err)
+	}
+
+	xmluiZip, err := download(2)
+	if err != nil {
+		return err
+	}
+	defer bundle.RemoveScratch(xmluiZip)
+	// Extract XMLUI components and place them in the mcp/docs and mcp/src directories
+	tmpDir := filepath.Join(l.installDir, "xmlui-source")
+	bundle.AddScratch(tmpDir)
+	os.MkdirAll(tmpDir, 0755)
+	if err := bundle.Extract(xmluiZip, tmpDir, opts.componentsFormat); err != nil {
+		return fail(2, "extract", "Failed to extract XMLUI source", err)
+	}
+
+	// Find the root of the extracted XMLUI source
+	var sourceRoot string
+	entries, _ := os.ReadDir(tmpDir)
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "xmlui-") {
+			sourceRoot = filepath.Join(tmpDir, e.Name())
+			break
+		}
+	}
+	if sourceRoot == "" {
+		archive := xmluiArchiveURL()
+		if opts.fromDir != "" {
+			archive = filepath.Join(opts.fromDir, localArchiveName(2))
+		}
+		return fail(2, "extract", "XMLUI source not found",
+			fmt.Errorf("expected an xmlui-* folder at the root of %s, found none", archive))
+	}
+	componentsSrc := filepath.Join(sourceRoot, filepath.FromSlash(opts.componentsStripPrefix), "src", "components")
+	if info, err := os.Stat(componentsSrc); err != nil || !info.IsDir() {
+		return fail(2, "config", "Component source not found",
+			fmt.Errorf("no %s/src/components in the XMLUI archive (check -components-strip-prefix)", opts.componentsStripPrefix))
+	}
+
+	// Setup mcp dir with docs and src
+	trackCreated(l.mcpDir)
+	trackCreated(l.docsDir)
+	trackCreated(l.srcDir)
+	os.MkdirAll(l.mcpDir, 0755)
+
+	// First ensure docs and src directories are created under mcp
+	os.MkdirAll(l.docsDir, 0755)
+	os.MkdirAll(l.srcDir, 0755)
+
+	// Copy components
+	// Set up components directories
+	os.MkdirAll(filepath.Join(l.docsDir, "pages", "components"), 0755)
+	os.MkdirAll(filepath.Join(l.srcDir, "components"), 0755)
+	recordSource(filepath.Join(l.docsDir, "pages", "components"), xmluiArchiveURL())
+	recordSource(filepath.Join(l.srcDir, "components"), xmluiArchiveURL())
+
+	if opts.componentsOnlyChanged {
+		// Only touch files whose content differs from what's already installed
+		var stats syncStats
+		if err := syncFiles(filepath.Join(sourceRoot, "docs", "pages", "components"), filepath.Join(l.docsDir, "pages", "components"), &stats); err != nil {
+			return fail(2, "filesystem", "Failed to update component docs", err)
+		}
+		if err := syncFiles(componentsSrc, filepath.Join(l.srcDir, "components"), &stats); err != nil {
+			return fail(2, "filesystem", "Failed to update component source", err)
+		}
+		bundle.Logf("✓ Updated components (%d changed, %d unchanged, %d removed)", stats.written, stats.unchanged, stats.removed)
+	} else {
+		// Copy component docs
+		if err := copyFiles(filepath.Join(sourceRoot, "docs", "pages", "components"), filepath.Join(l.docsDir, "pages", "components")); err != nil {
+			return fail(2, "filesystem", "Failed to copy component docs", err)
+		}
+
+		// Copy component source
+		if err := copyFiles(componentsSrc, filepath.Join(l.srcDir, "components")); err != nil {
+			return fail(2, "filesystem", "Failed to copy component source", err)
+		}
+
+		bundle.Logf("✓ Extracted components")
+	}
+
+	patterns := append(append([]string{}, defaultPrune...), opts.prune...)
+	if reclaimed, err := pruneTree(filepath.Join(l.srcDir, "components"), patterns); err != nil {
+		warnf("Could not prune component source: %v", err)
+	} else if reclaimed > 0 {
+		bundle.Logf("  Pruned component source, reclaimed %s", humanSize(reclaimed))
+	}
+
+	if intoDir != "" {
+		trackCreated(intoDir)
+		os.MkdirAll(intoDir, 0755)
+		if err := copyFiles(filepath.Join(l.srcDir, "components"), intoDir); err != nil {
+			return fail(2, "filesystem", "Failed to place components in the app", err)
+		}
+		recordSource(intoDir, xmluiArchiveURL())
+		bundle.Logf("  Placed component source in %s", intoDir)
+	}
+
+	// Clean up the source directory
+	bundle.RemoveScratch(tmpDir)
+	return nil
+}
+
+// componentsIntoDir resolves -components-into against the app dir, refusing
+// paths that would escape the install tree
+func componentsIntoDir(l *layout) (string, error) {
+	if opts.componentsInto == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(opts.componentsInto) {
+		return "", fmt.Errorf("%q must be relative to the app dir", opts.componentsInto)
+	}
+	dir := filepath.Join(l.appDir, filepath.FromSlash(opts.componentsInto))
+	rel, err := filepath.Rel(l.installDir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside the install directory", opts.componentsInto)
+	}
+	return dir, nil
+}
+
+// verifyComponents checks that every component named in the index file has
+// source under src/components, either as a directory or as <Name>.<ext>
+func verifyComponents(l *layout, index string) error {
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(l.appDir, index)
+	}
+	data, err := os.ReadFile(index)
+	if err != nil {
+		return err
+	}
+	componentsDir := filepath.Join(l.srcDir, "components")
+	var missing []string
+	for _, line := range strings.Split(string(data), "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(componentsDir, name)); err == nil {
+			continue
+		}
+		if matches, _ := filepath.Glob(filepath.Join(componentsDir, name+".*")); len(matches) > 0 {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing from %s: %s", componentsDir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// installMCP downloads the MCP tools into mcp/ (step 3)
+func installMCP(l *layout) error {
+	mcpUrl := getPlatformSpecificMCPURL(opts.mcpVersion)
+	mcpArchive, err := download(3)
+	if err != nil {
+		return err
+	}
+	defer bundle.RemoveScratch(mcpArchive)
+
+	trackCreated(l.mcpDir)
+	os.MkdirAll(l.mcpDir, 0755)
+
+	tmpMCP := filepath.Join(l.installDir, "mcpTmp")
+	bundle.AddScratch(tmpMCP)
+	os.MkdirAll(tmpMCP, 0755)
+
+	// Extract by content, not by the asset's file name
+	if err := bundle.Extract(mcpArchive, tmpMCP, "auto"); err != nil {
+		return fail(3, "extract", "Failed to extract MCP tools", err)
+	}
+
+	for _, name := range mcpFiles() {
+		src := filepath.Join(tmpMCP, name)
+		dst := filepath.Join(l.mcpDir, name)
+		trackCreated(dst)
+		if err := bundle.MoveOrCopy(src, dst); err != nil {
+			warnf("Skipping %s (not found?): %v", name, err)
+			continue
+		}
+		recordSource(dst, mcpUrl)
+		bundle.Logf("  Moved %s to %s", name, dst)
+		if err := checkBinaryPlatform(3, dst); err != nil {
+			return err
+		}
+
+		// Set executable permission for non-Windows executables
+		if strings.HasSuffix(name, ".sh") || !strings.Contains(name, ".") {
+			bundle.EnsureExecutable(dst)
+		}
+	}
+
+	// Clean up the temporary MCP directory
+	bundle.RemoveScratch(tmpMCP)
+
+	// Move docs and src under mcp if they exist at the root level (in the
+	// flat layout they're already where they belong). Step 2 has usually
+	// populated mcp/docs and mcp/src already, so merge rather than rename.
+	if l.mcpDir != l.installDir {
+		if _, err := os.Stat(filepath.Join(l.installDir, "docs")); err == nil {
+			if err := mergeInto(filepath.Join(l.installDir, "docs"), l.docsDir); err != nil {
+				warnf("Could not move docs directory: %v", err)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(l.installDir, "src")); err == nil {
+			if err := mergeInto(filepath.Join(l.installDir, "src"), l.srcDir); err != nil {
+				warnf("Could not move src directory: %v", err)
+			}
+		}
+	}
+
+	if opts.linkBin != "" {
+		if err := linkBinaries(l.mcpDir, opts.linkBin); err != nil {
+			warnf("Could not link MCP binaries into %s: %v", opts.linkBin, err)
+		}
+	}
+	return nil
+}
+
+// checkBinaryPlatform warns when the executable at path was built for
+// another OS or architecture, which would otherwise only show up as a
+// cryptic exec failure when it's first run. Under -strict that fails step.
+func checkBinaryPlatform(step int, path string) error {
+	err := bundle.CheckPlatform(path, runtime.GOOS, runtime.GOARCH)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if !errors.Is(err, bundle.ErrWrongPlatform) {
+		warnf("Could not check which platform %s is for: %v", filepath.Base(path), err)
+		return nil
+	}
+	if opts.strict {
+		return fail(step, "config", "Downloaded executable won't run here", err)
+	}
+	warnf("%v. Check -mcp-version and -server-version, or pass -strict to stop the install on this", err)
+	return nil
+}
+
+// mcpFiles lists the files installMCP takes from the MCP tools archive
+func mcpFiles() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"xmlui-mcp.exe", "xmlui-mcp-client.exe", "run-mcp-client.bat"}
+	}
+	return []string{"xmlui-mcp", "xmlui-mcp-client", "prepare-binaries.sh", "run-mcp-client.sh"}
+}
+
+// updateBinaries re-downloads the MCP tools and test server and atomically
+// replaces just their executables in an existing install
+func updateBinaries(l *layout) error {
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	targets := []struct {
+		step     int
+		what     string
+		url      string
+		dir      string
+		binaries []string
+		skip     bool
+	}{
+		{3, "MCP tools", getPlatformSpecificMCPURL(opts.mcpVersion), l.mcpDir,
+			[]string{"xmlui-mcp" + exe, "xmlui-mcp-client" + exe}, opts.skipMCP},
+		{4, "test server", getPlatformSpecificServerURL(opts.serverVersion), l.appDir,
+			[]string{"xmlui-test-server" + exe}, opts.skipServer},
+	}
+	for _, t := range targets {
+		if t.skip {
+			continue
+		}
+		currentStep = t.step
+		if info, err := os.Stat(t.dir); err != nil || !info.IsDir() {
+			return fail(t.step, "config", "Nothing to update", fmt.Errorf("%s is not installed in %s", t.what, t.dir))
+		}
+		bundle.Logf("Updating %s binaries...", t.what)
+		archive, err := download(t.step)
+		if err != nil {
+			return err
+		}
+		tmp := filepath.Join(l.installDir, "binariesTmp")
+		bundle.AddScratch(tmp)
+		os.MkdirAll(tmp, 0755)
+		if err := bundle.Extract(archive, tmp, "auto"); err != nil {
+			return fail(t.step, "extract", "Failed to extract "+t.what, err)
+		}
+		for _, name := range t.binaries {
+			dst := filepath.Join(t.dir, name)
+			if err := checkBinaryPlatform(t.step, filepath.Join(tmp, name)); err != nil {
+				return err
+			}
+			if err := replaceFile(filepath.Join(tmp, name), dst); err != nil {
+				warnf("Could not replace %s: %v", dst, err)
+				continue
+			}
+			recordSource(dst, t.url)
+			bundle.Logf("  Replaced %s", dst)
+		}
+		bundle.RemoveScratch(tmp)
+		bundle.RemoveScratch(archive)
 	}
+	return nil
 }
 
-func getPlatformSpecificServerURL() string {
-	baseURL := "https://github.com/JonUdell/xmlui-test-server/releases/download/v1.0.0/"
-	arch := runtime.GOARCH
-	switch runtime.GOOS {
-	case "darwin":
-		if arch == "arm64" {
-			return baseURL + "xmlui-test-server-mac-arm.tar.gz"
+// updateComponents re-downloads the XMLUI components into a staging dir next
+// to the installed ones and swaps them in only once they're complete, or
+// with -components-only-changed syncs just the changed files across
+func updateComponents(l *layout) error {
+	currentStep = 2
+	if _, err := os.Stat(l.srcDir); err != nil {
+		if _, err := os.Stat(l.appDir); err != nil {
+			return fail(2, "config", "Nothing to update", fmt.Errorf("no existing install in %s", l.installDir))
 		}
-		return baseURL + "xmlui-test-server-mac-amd.tar.gz"
-	case "linux":
-		return baseURL + "xmlui-test-server-linux-amd64.tar.gz"
-	case "windows":
-		return baseURL + "xmlui-test-server-windows-amd64.zip"
-	default:
-		return baseURL + "xmlui-test-server-mac-arm.tar.gz"
 	}
-}
-
-func downloadWithProgress(url, filename string) ([]byte, error) {
-	fmt.Printf("Downloading %s...\n", filename)
-	fmt.Printf("  From: %s\n", url)
+	bundle.Logf("Updating XMLUI components...")
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	staging := filepath.Join(l.mcpDir, ".components-new")
+	bundle.AddScratch(staging)
+	os.RemoveAll(staging)
+	staged := *l
+	staged.appDir = filepath.Join(staging, "app")
+	staged.mcpDir = staging
+	staged.docsDir = filepath.Join(staging, "docs")
+	staged.srcDir = filepath.Join(staging, "src")
+	// The staging dir starts empty, so there's nothing to sync against there
+	onlyChanged := opts.componentsOnlyChanged
+	opts.componentsOnlyChanged = false
+	err := installComponents(&staged)
+	opts.componentsOnlyChanged = onlyChanged
+	// Staging is scratch: what it held is recorded under its final paths below
+	forgetCreated(staging)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if opts.componentsVerify != "" {
+		if err := verifyComponents(&staged, opts.componentsVerify); err != nil {
+			return fail(2, "config", "Component set is incomplete, install left unchanged", err)
+		}
+		bundle.Logf("✓ Verified component set")
 	}
 
-	if strings.Contains(url, "codeload.github.com/xmlui-com/xmlui") {
-		token := os.Getenv("GITHUB_TOKEN")
-		if token != "" {
-			fmt.Println("  Using authentication token for private repository")
-			req.SetBasicAuth(token, "x-oauth-basic")
+	type move struct{ src, dst string }
+	var moves []move
+	for _, dir := range []string{filepath.Join("docs", "pages", "components"), filepath.Join("src", "components")} {
+		moves = append(moves, move{filepath.Join(staging, dir), filepath.Join(l.mcpDir, dir)})
+	}
+	if intoDir, _ := componentsIntoDir(l); intoDir != "" {
+		stagedInto, _ := componentsIntoDir(&staged)
+		moves = append(moves, move{stagedInto, intoDir})
+	}
+	var stats syncStats
+	for _, m := range moves {
+		trackCreated(m.dst)
+		os.MkdirAll(filepath.Dir(m.dst), 0755)
+		if onlyChanged {
+			if err := syncFiles(m.src, m.dst, &stats); err != nil {
+				return fail(2, "filesystem", "Failed to update "+m.dst, err)
+			}
 		} else {
-			fmt.Println("  Warning: No authentication token found for private repository")
+			if err := swapDir(m.src, m.dst); err != nil {
+				return fail(2, "filesystem", "Failed to replace "+m.dst, err)
+			}
+			bundle.Logf("  Replaced %s", m.dst)
 		}
+		recordSource(m.dst, xmluiArchiveURL())
 	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if onlyChanged {
+		bundle.Logf("✓ Updated components (%d changed, %d unchanged, %d removed)", stats.written, stats.unchanged, stats.removed)
 	}
-	defer resp.Body.Close()
+	bundle.RemoveScratch(staging)
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		if strings.Contains(url, "codeload.github.com/xmlui-com/xmlui") && resp.StatusCode == http.StatusUnauthorized {
-			return nil, fmt.Errorf("authentication failed for private repository: %s (status: %s) - check PAT_TOKEN", url, resp.Status)
-		}
-		return nil, fmt.Errorf("request failed: %s for URL: %s", resp.Status, url)
+// swapDir puts src in dst's place, restoring the original dst if the
+// move fails so the install is never left without the directory. Only the
+// move of src can cross filesystems; dst is set aside next to itself.
+func swapDir(src, dst string) error {
+	old := dst + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := bundle.MoveOrCopy(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
 	}
+	return os.RemoveAll(old)
+}
 
-	data, err := io.ReadAll(resp.Body)
+// replaceFile atomically swaps dst for the contents of src by writing a
+// temporary file next to dst and renaming it over the original
+func replaceFile(src, dst string) error {
+	data, err := os.ReadFile(src)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	tmp := dst + ".new"
+	perm := os.FileMode(0755)
+	if opts.noExecBit {
+		perm = 0644
+	}
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-	fmt.Printf("  Downloaded: %d bytes\n", len(data))
-	return data, nil
+	return nil
 }
 
-func unzipTo(data []byte, dest string) error {
-	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+// installServer extracts the test server into the app dir (step 4)
+func installServer(l *layout) error {
+	serverURL := getPlatformSpecificServerURL(opts.serverVersion)
+	serverArchive, err := download(4)
 	if err != nil {
 		return err
 	}
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
-			continue
-		}
-		os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
-		in, err := f.Open()
-		if err != nil {
+	defer bundle.RemoveScratch(serverArchive)
+
+	if err := bundle.Extract(serverArchive, l.appDir, "auto"); err != nil {
+		return fail(4, "extract", "Failed to extract server", err)
+	}
+	bundle.Walk(serverArchive, func(name string, size int64, mode os.FileMode) {
+		recordSource(filepath.Join(l.appDir, name), serverURL)
+	})
+
+	server := filepath.Join(l.appDir, "xmlui-test-server")
+	if runtime.GOOS == "windows" {
+		server += ".exe"
+	}
+	if _, err := os.Stat(server); err == nil {
+		if err := checkBinaryPlatform(4, server); err != nil {
 			return err
 		}
-		out, err := os.Create(fpath)
-		if err != nil {
-			return err
+	}
+
+	if runtime.GOOS == "windows" {
+		if err := writeStartBat(l.appDir); err != nil {
+			warnf("Could not write start.bat: %v", err)
 		}
-		io.Copy(out, in)
-		in.Close()
-		out.Close()
+	}
+
+	// Set executable permission for whatever starts the server: start.sh when
+	// the release ships one, otherwise the server binary itself
+	if launchPath := serverLaunchTarget(l.appDir); launchPath == "" {
+		warnf("Server archive contained neither start.sh nor a server binary")
+	} else {
+		bundle.EnsureExecutable(launchPath)
 	}
 	return nil
 }
 
-func untarGzTo(data []byte, dest string) error {
-	gzReader, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
+// linkBinaries makes the MCP binaries available from binDir: symlinks on Unix,
+// copies on Windows where symlinks need elevated privileges
+func linkBinaries(mcpDir, binDir string) error {
+	if err := os.MkdirAll(binDir, 0755); err != nil {
 		return err
 	}
-	tarReader := tar.NewReader(gzReader)
-	for {
-		hdr, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
+	names := []string{"xmlui-mcp", "xmlui-mcp-client"}
+	if runtime.GOOS == "windows" {
+		names = []string{"xmlui-mcp.exe", "xmlui-mcp-client.exe"}
+	}
+	for _, name := range names {
+		target, err := filepath.Abs(filepath.Join(mcpDir, name))
 		if err != nil {
 			return err
 		}
-		fpath := filepath.Join(dest, hdr.Name)
-		if hdr.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
+		if _, err := os.Stat(target); err != nil {
 			continue
 		}
-		os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
-		out, err := os.Create(fpath)
-		if err != nil {
-			return err
+		link := filepath.Join(binDir, name)
+		if _, err := os.Lstat(link); err == nil {
+			// Only ever replace what an install put there
+			if !opts.force && !isBundlerLink(link, target) {
+				warnf("Not linking %s: it already exists and isn't from an xmlui install (pass -force to replace it)", link)
+				continue
+			}
+			if err := os.Remove(link); err != nil {
+				return err
+			}
 		}
-		if _, err := io.Copy(out, tarReader); err != nil {
+		// Recorded for rollback and in the manifest, so uninstalling doesn't
+		// leave a dangling link behind
+		trackCreated(link)
+		if runtime.GOOS == "windows" {
+			data, err := os.ReadFile(target)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(link, data, 0755); err != nil {
+				return err
+			}
+		} else if err := os.Symlink(target, link); err != nil {
 			return err
 		}
-		out.Close()
+		bundle.Logf("  Linked %s -> %s", link, target)
+	}
 
-		// Set executable bit for script files and binaries
-		if strings.HasSuffix(fpath, ".sh") || filepath.Base(fpath) == "xmlui-mcp" ||
-		   filepath.Base(fpath) == "xmlui-mcp-client" || filepath.Base(fpath) == "xmlui-test-server" {
-			os.Chmod(fpath, 0755)
-			// Note: No need to remove quarantine on macOS for tar.gz files
-			// as the attribute won't be set on extraction
+	abs, _ := filepath.Abs(binDir)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if d, _ := filepath.Abs(dir); d == abs {
+			return nil
 		}
 	}
+	warnf("%s is not on your PATH", binDir)
 	return nil
 }
 
-func moveIntoPlace(srcParent, repoName, installDir string) (string, error) {
-	repoPrefix := repoName + "-"
-	entries, err := os.ReadDir(srcParent)
+// isBundlerLink reports whether link is what linkBinaries left there on an
+// earlier run: a symlink to a binary of the same name in an xmlui install
+// (one with a manifest.json beside or above the binary), or on Windows, a
+// copy identical to target
+func isBundlerLink(link, target string) bool {
+	if runtime.GOOS == "windows" {
+		a, errA := os.ReadFile(link)
+		b, errB := os.ReadFile(target)
+		return errA == nil && errB == nil && bytes.Equal(a, b)
+	}
+	dest, err := os.Readlink(link)
 	if err != nil {
-		return "", err
+		return false
 	}
-	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), repoPrefix) {
-			tmp := filepath.Join(srcParent, e.Name())
-			final := filepath.Join(installDir, repoName)
-			if err := os.Rename(tmp, final); err != nil {
-				return "", err
-			}
-			return final, nil
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(link), dest)
+	}
+	if dest == target {
+		return true
+	}
+	if filepath.Base(dest) != filepath.Base(link) {
+		return false
+	}
+	dir := filepath.Dir(dest)
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		if _, err := os.Stat(filepath.Join(d, manifestName)); err == nil {
+			return true
 		}
 	}
-	return "", fmt.Errorf("repo dir not found")
+	return false
 }
 
-func main() {
-	installDir, _ := os.Getwd()
-	os.MkdirAll(installDir, 0755)
+// pruneTree removes every file or directory under root whose name matches one
+// of the glob patterns, returning the number of bytes reclaimed
+func pruneTree(root string, patterns []string) (int64, error) {
+	var reclaimed int64
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		for _, pattern := range patterns {
+			matched, err := filepath.Match(pattern, d.Name())
+			if err != nil {
+				return fmt.Errorf("bad prune pattern %q: %w", pattern, err)
+			}
+			if !matched {
+				continue
+			}
+			size := dirSize(path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			reclaimed += size
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return nil
+	})
+	return reclaimed, err
+}
 
-	fmt.Println("Step 1/5: Downloading XMLUI invoice app...")
-	appZip, err := downloadWithProgress(appZipURL, "XMLUI invoice app")
-	if err != nil {
-		fmt.Println("Failed to download app:", err)
-		os.Exit(1)
+// dirSize sums the sizes of all regular files under root
+func dirSize(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// humanSize formats a byte count like "12.3 MB"
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
-	if err := unzipTo(appZip, installDir); err != nil {
-		fmt.Println("Failed to extract app:", err)
-		os.Exit(1)
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
 
-	appDir, err := moveIntoPlace(installDir, repoName, installDir)
-	if err != nil {
-		fmt.Println("Failed to organize app directory:", err)
-		os.Exit(1)
+// mergeInto moves the contents of directory src into dst, which may already
+// exist and have content. Subdirectories are merged recursively, files from
+// src replace files of the same name in dst, and src is removed at the end.
+func mergeInto(src, dst string) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return bundle.MoveOrCopy(src, dst)
 	}
-
-	fmt.Println("Step 2/5: Downloading XMLUI components...")
-	xmluiZip, err := downloadWithProgress(xmluiRepoZip, "XMLUI repo")
+	entries, err := os.ReadDir(src)
 	if err != nil {
-		fmt.Println("Failed to download XMLUI source:", err)
-		os.Exit(1)
-	}
-	// Extract XMLUI components and place them in the mcp/docs and mcp/src directories
-	tmpDir := filepath.Join(installDir, "xmlui-source")
-	os.MkdirAll(tmpDir, 0755)
-	if err := unzipTo(xmluiZip, tmpDir); err != nil {
-		fmt.Println("Failed to extract XMLUI source:", err)
-		os.Exit(1)
+		return err
 	}
-
-	// Find the root of the extracted XMLUI source
-	var sourceRoot string
-	entries, _ := os.ReadDir(tmpDir)
 	for _, e := range entries {
-		if e.IsDir() && strings.HasPrefix(e.Name(), "xmlui-") {
-			sourceRoot = filepath.Join(tmpDir, e.Name())
-			break
+		srcPath := filepath.Join(src, e.Name())
+		dstPath := filepath.Join(dst, e.Name())
+		info, err := os.Stat(dstPath)
+		switch {
+		case err == nil && info.IsDir() && e.IsDir():
+			err = mergeInto(srcPath, dstPath)
+		case err == nil:
+			if err = os.RemoveAll(dstPath); err == nil {
+				err = bundle.MoveOrCopy(srcPath, dstPath)
+			}
+		case os.IsNotExist(err):
+			err = bundle.MoveOrCopy(srcPath, dstPath)
+		}
+		if err != nil {
+			return err
 		}
 	}
+	return os.Remove(src)
+}
 
-	// Setup mcp dir with docs and src
-	mcpDir := filepath.Join(installDir, "mcp")
-	os.MkdirAll(mcpDir, 0755)
-
-	// First ensure docs and src directories are created under mcp
-	docsDir := filepath.Join(mcpDir, "docs")
-	srcDir := filepath.Join(mcpDir, "src")
-	os.MkdirAll(docsDir, 0755)
-	os.MkdirAll(srcDir, 0755)
-
-	// Copy components
-	if sourceRoot != "" {
-		// Set up components directories
-		os.MkdirAll(filepath.Join(docsDir, "pages", "components"), 0755)
-		os.MkdirAll(filepath.Join(srcDir, "components"), 0755)
+// copyFiles recursively copies files from src to dst directory
+func copyFiles(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
 
-		// Copy component docs
-		copyFiles(filepath.Join(sourceRoot, "docs", "pages", "components"), filepath.Join(docsDir, "pages", "components"))
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
 
-		// Copy component source
-		copyFiles(filepath.Join(sourceRoot, "xmlui", "src", "components"), filepath.Join(srcDir, "components"))
+		if entry.IsDir() {
+			os.MkdirAll(dstPath, 0755)
+			if err := copyFiles(srcPath, dstPath); err != nil {
+				return err
+			}
+		} else {
+			// Copy the file
+			data, err := os.ReadFile(srcPath)
+			if err != nil {
+				return err
+			}
 
-		fmt.Println("✓ Extracted components")
+			err = os.WriteFile(dstPath, data, 0644)
+			if err != nil {
+				return err
+			}
+			if info, err := entry.Info(); err == nil {
+				bundle.PreserveMtime(dstPath, info.ModTime())
+			}
+		}
 	}
 
-	// Clean up the source directory
-	_ = os.RemoveAll(tmpDir)
+	return nil
+}
+
+// syncStats counts what syncFiles did
+type syncStats struct {
+	written   int
+	unchanged int
+	removed   int
+}
 
-	fmt.Println("Step 3/5: Downloading MCP tools...")
-	mcpUrl := getPlatformSpecificMCPURL()
-	mcpArchive, err := downloadWithProgress(mcpUrl, "MCP tools")
+// syncFiles makes dst mirror src, rewriting only files whose SHA-256 differs
+// and removing files and directories that no longer exist in src
+func syncFiles(src, dst string, stats *syncStats) error {
+	entries, err := os.ReadDir(src)
 	if err != nil {
-		fmt.Println("Failed to download MCP tools:", err)
-		os.Exit(1)
+		return err
 	}
+	os.MkdirAll(dst, 0755)
 
-	tmpMCP := filepath.Join(installDir, "mcpTmp")
-	os.MkdirAll(tmpMCP, 0755)
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		wanted[entry.Name()] = true
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
 
-	// Extract based on file type
-	if strings.HasSuffix(mcpUrl, ".zip") {
-		err = unzipTo(mcpArchive, tmpMCP)
-	} else {
-		err = untarGzTo(mcpArchive, tmpMCP)
-	}
+		if entry.IsDir() {
+			if err := syncFiles(srcPath, dstPath, stats); err != nil {
+				return err
+			}
+			continue
+		}
 
-	if err != nil {
-		fmt.Println("Failed to extract MCP tools:", err)
-		os.Exit(1)
+		data, err := os.ReadFile(srcPath)
+		if err != nil {
+			return err
+		}
+		if existing, err := os.ReadFile(dstPath); err == nil && sha256.Sum256(existing) == sha256.Sum256(data) {
+			stats.unchanged++
+			continue
+		}
+		if err := os.WriteFile(dstPath, data, 0644); err != nil {
+			return err
+		}
+		if info, err := entry.Info(); err == nil {
+			bundle.PreserveMtime(dstPath, info.ModTime())
+		}
+		stats.written++
 	}
 
-	var expectedFiles []string
-	if runtime.GOOS == "windows" {
-		expectedFiles = []string{"xmlui-mcp.exe", "xmlui-mcp-client.exe", "run-mcp-client.bat"}
-	} else {
-		expectedFiles = []string{"xmlui-mcp", "xmlui-mcp-client", "prepare-binaries.sh", "run-mcp-client.sh"}
+	// Drop anything the new version no longer ships
+	existing, err := os.ReadDir(dst)
+	if err != nil {
+		return err
 	}
-
-	for _, name := range expectedFiles {
-		src := filepath.Join(tmpMCP, name)
-		dst := filepath.Join(mcpDir, name)
-		if err := os.Rename(src, dst); err != nil {
-			fmt.Printf("  Skipping %s (not found?): %v\n", name, err)
+	for _, entry := range existing {
+		if wanted[entry.Name()] {
 			continue
 		}
-		fmt.Printf("  Moved %s to %s\n", name, dst)
+		if err := os.RemoveAll(filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+		stats.removed++
+	}
 
-		// Set executable permission for non-Windows executables
-		if runtime.GOOS != "windows" && (strings.HasSuffix(name, ".sh") || !strings.Contains(name, ".")) {
-			os.Chmod(dst, 0755)
+	return nil
+}
+
+// runDoctor checks the environment for the problems new users most often hit
+// and prints a pass/fail report with hints. It returns false if any check failed.
+func runDoctor(installDir string) bool {
+	w := bundle.Output
+	ok := true
+	report := func(name string, err error, hint string) {
+		if err == nil {
+			fmt.Fprintf(w, "[PASS] %s\n", name)
+			return
+		}
+		ok = false
+		fmt.Fprintf(w, "[FAIL] %s: %v\n", name, err)
+		if hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", hint)
 		}
 	}
 
-	// Clean up the temporary MCP directory
-	_ = os.RemoveAll(tmpMCP)
+	fmt.Fprintf(w, "Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
 
-	// Move docs and src under mcp if they exist at the root level
-	if _, err := os.Stat(filepath.Join(installDir, "docs")); err == nil {
-		if err := os.Rename(filepath.Join(installDir, "docs"), docsDir); err != nil {
-			fmt.Printf("Warning: Could not move docs directory: %v\n", err)
+	hosts := []string{"https://github.com", "https://codeload.github.com"}
+	if opts.mirror != "" {
+		hosts = []string{opts.mirror}
+	}
+	for _, host := range hosts {
+		resp, err := bundle.Client.Head(host)
+		if err == nil {
+			resp.Body.Close()
 		}
+		report("network: reach "+host, err, "check your connection or proxy settings")
 	}
 
-	if _, err := os.Stat(filepath.Join(installDir, "src")); err == nil {
-		if err := os.Rename(filepath.Join(installDir, "src"), srcDir); err != nil {
-			fmt.Printf("Warning: Could not move src directory: %v\n", err)
+	report("write access to "+installDir, checkWritable(installDir), "run from (or pass -install-dir) a directory you can write to")
+
+	// The install dir may not exist yet; its volume is that of the nearest
+	// parent that does
+	volume := installDir
+	for {
+		if _, err := os.Stat(volume); err == nil || filepath.Dir(volume) == volume {
+			break
+		}
+		volume = filepath.Dir(volume)
+	}
+	// As with inodes, platforms that can't say are left out
+	if free, err := bundle.FreeSpace(volume); err == nil {
+		report(fmt.Sprintf("disk space (%d MB free)", free>>20), checkDiskSpace(volume),
+			"free up space on that volume, or pass -install-dir on another one")
+	}
+	// Only some platforms count inodes
+	if inodes, err := bundle.FreeInodes(volume); err == nil {
+		var inodeErr error
+		if inodes < minInodes {
+			inodeErr = fmt.Errorf("only %d free inodes, and an install creates thousands of files", inodes)
 		}
+		report(fmt.Sprintf("free inodes (%d)", inodes), inodeErr,
+			"delete unneeded small files on that volume, or pass -install-dir on another one")
 	}
 
-	fmt.Println("Step 4/5: Downloading XMLUI test server...")
-	serverURL := getPlatformSpecificServerURL()
-	serverArchive, err := downloadWithProgress(serverURL, "test server")
-	if err != nil {
-		fmt.Println("Failed to download server:", err)
-		os.Exit(1)
+	skewErr := func() error {
+		skew, err := clockSkew()
+		if err != nil || skew.Abs() <= maxClockSkew {
+			return err
+		}
+		return fmt.Errorf("system clock appears off by %s", skew.Round(time.Second))
+	}()
+	report("system clock", skewErr, "set the clock (or enable network time); TLS and caching depend on it")
+
+	if opts.mirror == "" {
+		report("token for private XMLUI repo", checkToken(),
+			"set GITHUB_TOKEN to a token with access to xmlui-com/xmlui")
 	}
 
-	if strings.HasSuffix(serverURL, ".zip") {
-		err = unzipTo(serverArchive, appDir)
-	} else {
-		err = untarGzTo(serverArchive, appDir)
+	if err := checkPlatform(); err != nil {
+		report("published build for "+runtime.GOOS+"/"+runtime.GOARCH, err, "")
+		return ok
 	}
+	report("MCP tools asset for this platform", assetExists(getPlatformSpecificMCPURL(opts.mcpVersion)),
+		"check -mcp-version, or whether this platform has a published build")
+	report("test server asset for this platform", assetExists(getPlatformSpecificServerURL(opts.serverVersion)),
+		"this platform may not have a published test server build")
+
+	return ok
+}
+
+// minInodes is the fewest free inodes -doctor accepts: the components
+// alone unpack to a few thousand files
+const minInodes = 10000
 
+// maxClockSkew is how far the local clock may drift from GitHub's before
+// certificate checks and conditional requests start to misbehave
+const maxClockSkew = 5 * time.Minute
+
+// clockSkew measures how far the local clock is ahead of the Date header
+// GitHub sends. It asks over plain HTTP and stops at the redirect to https,
+// so it still works when a wrong clock is what's breaking TLS.
+func clockSkew() (time.Duration, error) {
+	client := &http.Client{
+		Transport:     bundle.Client.Transport,
+		Timeout:       10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	host := "http://github.com"
+	if opts.mirror != "" {
+		// Air-gapped installs can't reach GitHub, but the mirror has a clock too
+		host = opts.mirror
+	}
+	resp, err := client.Head(host)
 	if err != nil {
-		fmt.Println("Failed to extract server:", err)
-		os.Exit(1)
+		return 0, err
 	}
-
-	// Set executable permission for start.sh
-	startScriptPath := filepath.Join(appDir, "start.sh")
-	if runtime.GOOS != "windows" {
-		os.Chmod(startScriptPath, 0755)
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header: %w", err)
 	}
+	return time.Since(date), nil
+}
 
-	// The final bundle should contain only these files/directories:
-	// - xmlui-invoice/  (the invoice app)
-	// - mcp/  (with docs/ and src/ inside it)
-	// - XMLUI_GETTING_STARTED_README.md
-
-	// Write a cleanup script that will remove files not in the include list
-	if runtime.GOOS == "windows" {
-		cleanupScript := "@echo off\r\n"
-		cleanupScript += "echo Cleaning up temporary files...\r\n"
-		cleanupScript += fmt.Sprintf("if exist \"%s\" del \"%s\"\r\n", filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
-		cleanupScript += "if exist *.zip del *.zip\r\n"
-		cleanupScript += "del cleanup.bat\r\n"
-		os.WriteFile(filepath.Join(installDir, "cleanup.bat"), []byte(cleanupScript), 0755)
-		fmt.Println("Note: Run cleanup.bat to remove the bundler executable and temporary files")
-	} else {
-		cleanupScript := "#!/bin/sh\n"
-		cleanupScript += "echo Cleaning up temporary files...\n"
-		cleanupScript += fmt.Sprintf("rm -f \"%s\"\n", filepath.Base(os.Args[0]))
-		cleanupScript += "rm -f *.zip\n"
-		cleanupScript += "rm -f *.tar.gz\n"
-		cleanupScript += "rm -f cleanup.sh\n"
-		os.WriteFile(filepath.Join(installDir, "cleanup.sh"), []byte(cleanupScript), 0755)
-		os.Chmod(filepath.Join(installDir, "cleanup.sh"), 0755)
-		fmt.Println("Note: Run ./cleanup.sh to remove the bundler executable and temporary files")
-	}
-
-	fmt.Println("✓ Organized layout complete")
-	fmt.Printf("\nInstall location: %s\n", installDir)
+// warnClockSkew turns a badly set clock into a warning up front instead of
+// an inscrutable certificate error later
+func warnClockSkew() {
+	skew, err := clockSkew()
+	if err != nil {
+		// The downloads will report the network problem themselves
+		return
+	}
+	if skew.Abs() > maxClockSkew {
+		warnf("system clock appears off by %s; TLS/caching may fail", skew.Round(time.Second))
+	}
 }
 
-// copyFiles recursively copies files from src to dst directory
-func copyFiles(src, dst string) error {
-	entries, err := os.ReadDir(src)
+// checkToken verifies GITHUB_TOKEN is present and can read the private XMLUI repo
+func checkToken() error {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return fmt.Errorf("GITHUB_TOKEN is not set")
+	}
+	req, err := http.NewRequest("HEAD", xmluiRepoZip, nil)
 	if err != nil {
 		return err
 	}
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			os.MkdirAll(dstPath, 0755)
-			if err := copyFiles(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			// Copy the file
-			data, err := os.ReadFile(srcPath)
-			if err != nil {
-				return err
-			}
-
-			err = os.WriteFile(dstPath, data, 0644)
-			if err != nil {
-				return err
-			}
-		}
+	req.SetBasicAuth(token, "x-oauth-basic")
+	resp, err := bundle.Client.Do(req)
+	if err != nil {
+		return err
 	}
-
-	return nil
-}
\ No newline at end of file
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return fmt.Errorf("token was rejected (status: %s) - it may be expired or lack repo scope", resp.Status)
+	}
+	return fmt.Errorf("unexpected status: %s", resp.Status)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonudell/xmlui-bundler/internal/bundle"
+)
+
+// cleanupDir lays out dir as an install dir holding scratch left by an
+// interrupted run next to what the install put there, with keep.zip recorded
+// in the manifest as installed and the bundler run from inside it
+func cleanupDir(t *testing.T, dir string) string {
+	t.Helper()
+	opts.appRepo = defaultAppRepo
+	t.Cleanup(func() { created.paths = nil })
+	runFrom(t, filepath.Join(dir, "xmlui-bundler"))
+	for _, name := range []string{
+		"xmlui-invoice/index.html", "mcp/xmlui-mcp", "keep.zip",
+		"app.zip", "server.tar.gz", ".xmlui-download-123", "xmlui-source/xmlui-main/README.md",
+		"mcpTmp/xmlui-mcp", "xmlui-invoice-main/index.html", "xmlui-bundler",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := `{"schema_version": 1, "created": [".", "xmlui-invoice", "mcp", "keep.zip"]}`
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// runFrom makes the bundler appear to run from exe
+func runFrom(t *testing.T, exe string) {
+	t.Helper()
+	saved := executable
+	executable = func() (string, error) { return exe, nil }
+	t.Cleanup(func() { executable = saved })
+}
+
+// remaining lists the top-level entries of dir
+func remaining(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestCleanupScriptSh(t *testing.T) {
+	runCleanupSh(t, cleanupDir(t, t.TempDir()), "keep.zip manifest.json mcp xmlui-invoice")
+}
+
+// Install paths like /Users/José García/My Apps have broken unquoted scripts
+func TestCleanupScriptShUnusualPath(t *testing.T) {
+	runCleanupSh(t, cleanupDir(t, filepath.Join(t.TempDir(), "My Apps", "José")), "keep.zip manifest.json mcp xmlui-invoice")
+}
+
+// The bundler run from elsewhere mustn't take a same-named file with it
+func TestCleanupScriptExeOutside(t *testing.T) {
+	dir := cleanupDir(t, t.TempDir())
+	runFrom(t, filepath.Join(t.TempDir(), "xmlui-bundler"))
+	runCleanupSh(t, dir, "keep.zip manifest.json mcp xmlui-bundler xmlui-invoice")
+
+	if err := writeCleanupScript(dir, "windows"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "cleanup.bat"))
+	if strings.Contains(string(data), "xmlui-bundler") {
+		t.Errorf("cleanup.bat deletes an xmlui-bundler the bundler didn't run from:\n%s", data)
+	}
+}
+
+// runCleanupSh writes cleanup.sh into dir, runs it, and checks it removed
+// just the scratch, leaving the entries in want
+func runCleanupSh(t *testing.T, dir string, want string) {
+	t.Helper()
+	if err := writeCleanupScript(dir, "linux"); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "cleanup.sh")
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run cleanup.sh with")
+	}
+	if out, err := exec.Command(sh, "-n", script).CombinedOutput(); err != nil {
+		t.Fatalf("cleanup.sh doesn't parse: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(sh, script).CombinedOutput(); err != nil {
+		t.Fatalf("cleanup.sh failed: %v\n%s", err, out)
+	}
+	got := strings.Join(remaining(t, dir), " ")
+	if got != want {
+		t.Errorf("cleanup.sh left %q, want %q", got, want)
+	}
+}
+
+func TestCleanupScriptBat(t *testing.T) {
+	dir := cleanupDir(t, t.TempDir())
+	if err := writeCleanupScript(dir, "windows"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "cleanup.bat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+	if strings.Count(script, "\n") != strings.Count(script, "\r\n") {
+		t.Error("cleanup.bat has lines not ending in CRLF")
+	}
+	lines := strings.Split(strings.TrimSuffix(script, "\r\n"), "\r\n")
+	for _, line := range lines {
+		if strings.Count(line, `"`)%2 != 0 {
+			t.Errorf("unbalanced quotes: %s", line)
+		}
+	}
+	if lines[0] != "@echo off" || lines[len(lines)-1] != `(goto) 2>nul & del "%~f0"` {
+		t.Errorf("cleanup.bat starts %q and ends %q", lines[0], lines[len(lines)-1])
+	}
+	for _, want := range []string{
+		`del "xmlui-bundler"`,
+		`for %%f in ("*.zip") do if /i not "%%~nxf"=="keep.zip" del /q "%%f"`,
+		`for %%f in ("*.tar.gz") do del /q "%%f"`,
+		`for /d %%d in ("xmlui-source") do rmdir /s /q "%%d"`,
+		`for /d %%d in ("xmlui-invoice-*") do rmdir /s /q "%%d"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("cleanup.bat is missing %s", want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cleanup.sh")); err == nil {
+		t.Error("cleanup.sh was written for windows")
+	}
+}
+
+// byHost sends every request to target, moving the original host into the
+// path so one server can answer for GitHub and the CDN
+type byHost struct {
+	target *url.URL
+}
+
+func (rt byHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Path = "/" + req.URL.Host + req.URL.Path
+	req.URL.Scheme, req.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadAssetCDNChecksumMismatch(t *testing.T) {
+	const asset = "/JonUdell/xmlui-mcp/releases/download/v1/xmlui-mcp.zip"
+	good := []byte("the real tools")
+	sum := sha256.Sum256(good)
+	files := map[string][]byte{
+		"/github.com" + asset:             good,
+		"/github.com" + asset + ".sha256": []byte(hex.EncodeToString(sum[:]) + "  xmlui-mcp.zip\n"),
+		"/cdn.example" + asset:            []byte("tampered"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	client, dir, cacheDir, cdn := bundle.Client, bundle.Dir, bundle.CacheDir, opts.cdn
+	bundle.Client = &http.Client{Transport: byHost{target: target}}
+	bundle.Dir, bundle.CacheDir, opts.cdn = t.TempDir(), "", "https://cdn.example/"
+	t.Cleanup(func() { bundle.Client, bundle.Dir, bundle.CacheDir, opts.cdn = client, dir, cacheDir, cdn })
+
+	archive, err := downloadAsset("https://github.com"+asset, "MCP tools")
+	if err != nil {
+		t.Fatalf("got %v, want the GitHub copy after the CDN's failed its checksum", err)
+	}
+	defer bundle.RemoveScratch(archive)
+	if got, _ := os.ReadFile(archive); string(got) != string(good) {
+		t.Errorf("got %q, want GitHub's %q", got, good)
+	}
+	if entries, _ := os.ReadDir(bundle.Dir); len(entries) != 1 {
+		t.Errorf("staging dir holds %d files, want only the GitHub copy", len(entries))
+	}
+}
+
+// captureStdout runs fn and returns what it wrote to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestExitStatusUsageJSON(t *testing.T) {
+	opts.json = true
+	t.Cleanup(func() { opts.json = false })
+	var code int
+	out := captureStdout(t, func() { code = exitStatus(usagef("Invalid -mirror: %w", errors.New("not an http(s) URL"))) })
+	if code != 2 {
+		t.Errorf("exit status %d, want 2", code)
+	}
+	var e progressEvent
+	if err := json.Unmarshal([]byte(out), &e); err != nil {
+		t.Fatalf("stdout isn't one JSON record: %q", out)
+	}
+	if e.Event != "error" || e.Kind != "config" || !strings.Contains(e.Message, "Invalid -mirror") {
+		t.Errorf("got %+v, want a config error naming -mirror", e)
+	}
+}
+
+func TestInstalledWithin(t *testing.T) {
+	dir := t.TempDir()
+	if recent, _ := installedWithin(dir, time.Hour); recent {
+		t.Error("a dir with no manifest counts as recently installed")
+	}
+	writeManifest(dir)
+	t.Cleanup(func() { created.paths = nil })
+	if recent, _ := installedWithin(dir, time.Hour); !recent {
+		t.Error("a manifest written just now doesn't count as within an hour")
+	}
+	if recent, _ := installedWithin(dir, 0); recent {
+		t.Error("without -since, an update was skipped")
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.InstalledAt = m.InstalledAt.Add(-2 * time.Hour)
+	data, _ := json.Marshal(m)
+	os.WriteFile(filepath.Join(dir, manifestName), data, 0644)
+	if recent, age := installedWithin(dir, time.Hour); recent || age < 2*time.Hour {
+		t.Errorf("an install 2h old counts as within an hour (age %s)", age)
+	}
+}
+
+func TestLinkBinaries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("links are copies on Windows")
+	}
+	t.Cleanup(func() { created.paths = nil })
+	install := func(dir string) string {
+		mcp := filepath.Join(dir, "mcp")
+		os.MkdirAll(mcp, 0755)
+		os.WriteFile(filepath.Join(dir, manifestName), []byte(`{"schema_version": 1}`), 0644)
+		for _, name := range []string{"xmlui-mcp", "xmlui-mcp-client"} {
+			os.WriteFile(filepath.Join(mcp, name), []byte(name), 0755)
+		}
+		return mcp
+	}
+	mcpDir := install(t.TempDir())
+	earlier := install(t.TempDir())
+	bin := t.TempDir()
+	// The user's own xmlui-mcp, and a link an earlier install left
+	os.WriteFile(filepath.Join(bin, "xmlui-mcp"), []byte("mine"), 0755)
+	os.Symlink(filepath.Join(earlier, "xmlui-mcp-client"), filepath.Join(bin, "xmlui-mcp-client"))
+
+	if err := linkBinaries(mcpDir, bin); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(bin, "xmlui-mcp")); string(got) != "mine" {
+		t.Errorf("the user's xmlui-mcp was replaced with %q", got)
+	}
+	client := filepath.Join(bin, "xmlui-mcp-client")
+	if dest, _ := os.Readlink(client); dest != filepath.Join(mcpDir, "xmlui-mcp-client") {
+		t.Errorf("xmlui-mcp-client links to %q, want this install's", dest)
+	}
+	if !slices.Contains(created.paths, client) || slices.Contains(created.paths, filepath.Join(bin, "xmlui-mcp")) {
+		t.Errorf("tracked %v, want just the new link", created.paths)
+	}
+}
+
+// writeTree writes files, by slash path, under dir
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Updating over an existing install replaces the component docs, source and
+// -components-into copy, and the manifest lists them with the new archive
+func TestUpdateComponents(t *testing.T) {
+	for _, onlyChanged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("only-changed=%v", onlyChanged), func(t *testing.T) {
+			saved, savedDir := opts, bundle.Dir
+			t.Cleanup(func() {
+				opts, bundle.Dir = saved, savedDir
+				created.paths, created.sources = nil, nil
+			})
+			opts.appRepo, opts.componentsRef, opts.componentsFormat = defaultAppRepo, "refs/heads/main", "zip"
+			opts.componentsStripPrefix, opts.componentsInto = "xmlui", "components"
+			opts.componentsOnlyChanged = onlyChanged
+
+			// The newer xmlui archive, in -from-dir
+			opts.fromDir = t.TempDir()
+			archive, err := os.Create(filepath.Join(opts.fromDir, localArchiveName(2)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			zw := zip.NewWriter(archive)
+			for name, body := range map[string]string{
+				"xmlui-main/docs/pages/components/Button.md":        "new button",
+				"xmlui-main/docs/pages/components/Text.md":          "text",
+				"xmlui-main/xmlui/src/components/Button/Button.tsx": "new button",
+				"xmlui-main/xmlui/src/components/Text/Text.tsx":     "text",
+			} {
+				w, _ := zw.Create(name)
+				w.Write([]byte(body))
+			}
+			zw.Close()
+			archive.Close()
+
+			// An install of the older version, with Text unchanged and Old since removed
+			installDir := t.TempDir()
+			bundle.Dir = installDir
+			l := newLayout(installDir)
+			old := map[string]string{
+				"docs/pages/components/Button.md":  "old button",
+				"docs/pages/components/Text.md":    "text",
+				"docs/pages/components/Old.md":     "old",
+				"src/components/Button/Button.tsx": "old button",
+				"src/components/Text/Text.tsx":     "text",
+				"src/components/Old/Old.tsx":       "old",
+			}
+			writeTree(t, l.mcpDir, old)
+			writeTree(t, filepath.Join(l.appDir, "components"), map[string]string{"Old/Old.tsx": "old", "Text/Text.tsx": "text"})
+			manifest := `{"schema_version": 1, "created": [".", "xmlui-invoice", "mcp"]}`
+			if err := os.WriteFile(filepath.Join(installDir, manifestName), []byte(manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			unchanged := filepath.Join(l.docsDir, "pages", "components", "Text.md")
+			stamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			os.Chtimes(unchanged, stamp, stamp)
+
+			if err := updateComponents(l); err != nil {
+				t.Fatal(err)
+			}
+			writeManifest(installDir)
+
+			for dir, want := range map[string]map[string]string{
+				filepath.Join(l.docsDir, "pages", "components"): {"Button.md": "new button", "Text.md": "text"},
+				filepath.Join(l.srcDir, "components"):           {"Button/Button.tsx": "new button", "Text/Text.tsx": "text"},
+				filepath.Join(l.appDir, "components"):           {"Button/Button.tsx": "new button", "Text/Text.tsx": "text"},
+			} {
+				var got []string
+				filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+					if err == nil && !d.IsDir() {
+						rel, _ := filepath.Rel(dir, path)
+						got = append(got, filepath.ToSlash(rel))
+						if data, _ := os.ReadFile(path); string(data) != want[filepath.ToSlash(rel)] {
+							t.Errorf("%s/%s holds %q, want %q", dir, rel, data, want[filepath.ToSlash(rel)])
+						}
+					}
+					return nil
+				})
+				if len(got) != len(want) {
+					t.Errorf("%s holds %v, want %d files", dir, got, len(want))
+				}
+			}
+			if info, err := os.Stat(unchanged); onlyChanged && (err != nil || !info.ModTime().Equal(stamp)) {
+				t.Errorf("the unchanged Text.md was rewritten")
+			}
+			if _, err := os.Stat(filepath.Join(l.mcpDir, ".components-new")); err == nil {
+				t.Error("the staging dir was left behind")
+			}
+
+			m, err := readManifest(installDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i := slices.IndexFunc(m.Created, func(p string) bool { return strings.Contains(p, ".components-new") }); i >= 0 {
+				t.Errorf("manifest lists the staging dir %s", m.Created[i])
+			}
+			for _, want := range []string{"mcp/src/components/Button/Button.tsx", "xmlui-invoice/components/Text/Text.tsx"} {
+				i := slices.IndexFunc(m.Files, func(f manifestFile) bool { return f.Path == want })
+				if i < 0 {
+					t.Errorf("manifest doesn't list %s", want)
+				} else if m.Files[i].URL != xmluiArchiveURL() {
+					t.Errorf("manifest has %s from %q, want %q", want, m.Files[i].URL, xmluiArchiveURL())
+				}
+			}
+		})
+	}
+}
+
+// Under -json every line on stdout is a JSON record, whatever the bundler
+// was asked to do; the reports meant for people go to stderr. The bundler
+// runs in a child process, since main parses flags and exits.
+func TestJSONStdout(t *testing.T) {
+	if args := os.Getenv("XMLUI_BUNDLER_ARGS"); args != "" {
+		os.Args = append([]string{"xmlui-bundler"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	installDir := t.TempDir()
+	writeTree(t, installDir, map[string]string{"mcp/xmlui-mcp": "tools"})
+	manifest := `{"schema_version": 1, "created": ["mcp"]}`
+	if err := os.WriteFile(filepath.Join(installDir, manifestName), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"-doctor", "-mirror", srv.URL},
+		{"-uninstall"},
+		{"-uninstall", "-yes"},
+		{"-uninstall", "-yes"},
+	} {
+		args = append(args, "-json", "-allow-root", "-install-dir", installDir)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestJSONStdout$")
+		cmd.Env = append(os.Environ(), "XMLUI_BUNDLER_ARGS="+strings.Join(args, "\n"))
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		cmd.Run()
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			var e progressEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Errorf("%v: stdout line isn't JSON: %q", args, line)
+			}
+		}
+		if stderr.Len() == 0 {
+			t.Errorf("%v: wrote nothing to stderr", args)
+		}
+	}
+}